@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Redis list of audit entries as JSON, newest first. Entries are only ever added.
+const AUDIT_KEY = "airhorn:audit"
+
+// Most entries `@bot audit` will show, and how far back it looks when filtering by user
+const (
+	AUDIT_QUERY_DEFAULT = 10
+	AUDIT_QUERY_MAX     = 50
+	AUDIT_QUERY_SCAN    = 1000
+)
+
+// AuditEntry records one privileged action
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Guild   string    `json:"guild,omitempty"`
+	Action  string    `json:"action"`
+	Args    []string  `json:"args,omitempty"`
+	Outcome string    `json:"outcome"`
+}
+
+var (
+	// Local file audit entries are appended to as JSON lines, if -audit is set
+	AUDIT_FILE     string
+	auditFileMutex sync.Mutex
+)
+
+func (e *AuditEntry) String() string {
+	return fmt.Sprintf("%s %s guild:%s %s %s -> %s",
+		e.Time.Format("2006-01-02 15:04:05"),
+		e.Actor,
+		e.Guild,
+		e.Action,
+		strings.Join(e.Args, " "),
+		e.Outcome)
+}
+
+// Records a privileged action, like an operator's control command or a change to a guild's
+// settings. A nil err means it worked.
+func audit(actorID, guildID, action string, args []string, err error) {
+	entry := &AuditEntry{
+		Time:    time.Now(),
+		Actor:   actorID,
+		Guild:   guildID,
+		Action:  action,
+		Args:    args,
+		Outcome: "ok",
+	}
+	if err != nil {
+		entry.Outcome = err.Error()
+	}
+
+	log.WithFields(log.Fields{
+		"actor":   entry.Actor,
+		"level":   operatorLevel(actorID),
+		"guild":   entry.Guild,
+		"action":  entry.Action,
+		"args":    strings.Join(entry.Args, " "),
+		"outcome": entry.Outcome,
+	}).Info("Audit")
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	if rcli != nil {
+		if err := rcli.LPush(AUDIT_KEY, string(data)).Err(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to save audit entry")
+		}
+	}
+
+	if AUDIT_FILE != "" {
+		auditFileMutex.Lock()
+		defer auditFileMutex.Unlock()
+
+		file, err := os.OpenFile(AUDIT_FILE, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.Write(append(data, '\n'))
+			file.Close()
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  AUDIT_FILE,
+				"error": err,
+			}).Error("Failed to write audit entry")
+		}
+	}
+}
+
+// auditLog is the AuditSink commands use for real
+type auditLog struct{}
+
+func (auditLog) Record(actorID, guildID, action string, args []string, err error) {
+	audit(actorID, guildID, action, args, err)
+}
+
+// Records a guild admin command, eg `!policy maxlength 20s` becomes the action `policy maxlength`
+func auditCommand(sink AuditSink, m *discordgo.MessageCreate, guildID string, err error) {
+	words := strings.Fields(strings.ToLower(m.Content))
+	if len(words) == 0 {
+		return
+	}
+
+	action, args := strings.TrimPrefix(words[0], "!"), words[1:]
+	if len(args) > 0 {
+		action, args = action+" "+args[0], args[1:]
+	}
+	sink.Record(m.Author.ID, guildID, action, args, err)
+}
+
+// Loads recent audit entries, newest first, from redis or failing that the audit file
+func recentAuditEntries(limit int) ([]*AuditEntry, error) {
+	var lines []string
+	if rcli != nil {
+		var err error
+		if lines, err = rcli.LRange(AUDIT_KEY, 0, int64(limit-1)).Result(); err != nil {
+			return nil, err
+		}
+	} else if AUDIT_FILE != "" {
+		auditFileMutex.Lock()
+		file, err := os.Open(AUDIT_FILE)
+		if err != nil {
+			auditFileMutex.Unlock()
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+		auditFileMutex.Unlock()
+
+		if len(lines) > limit {
+			lines = lines[len(lines)-limit:]
+		}
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+	} else {
+		return nil, fmt.Errorf("there's nowhere to read the audit log from, run with -r or -audit")
+	}
+
+	entries := make([]*AuditEntry, 0, len(lines))
+	for _, line := range lines {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(line), entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Handles `@bot audit [count] [@user|user id]`, showing recent audit entries
+func runAuditQuery(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+	count, actor := AUDIT_QUERY_DEFAULT, ""
+	for _, arg := range parts[2:] {
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 && n < 1000 {
+			count = n
+		} else if arg != "" {
+			actor = arg
+		}
+	}
+
+	if user := utilGetMentioned(s, m); user != nil {
+		actor = user.ID
+	}
+
+	if count > AUDIT_QUERY_MAX {
+		count = AUDIT_QUERY_MAX
+	}
+
+	scan := count
+	if actor != "" {
+		scan = AUDIT_QUERY_SCAN
+	}
+
+	entries, err := recentAuditEntries(scan)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to read the audit log: %s", err))
+		return err
+	}
+
+	// Stop early rather than go over Discord's message length limit
+	lines, length := make([]string, 0, count), 0
+	for _, entry := range entries {
+		if len(lines) == count {
+			break
+		} else if actor != "" && entry.Actor != actor {
+			continue
+		}
+
+		line := entry.String()
+		if length += len(line) + 1; length > 1900 {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Nothing in the audit log.")
+		return nil
+	}
+	s.ChannelMessageSend(m.ChannelID, "```\n"+strings.Join(lines, "\n")+"\n```")
+	return nil
+}
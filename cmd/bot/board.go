@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Board is a soundboard message. Each reaction on it maps to a sound in a collection, and big
+// collections are split over pages the arrow reactions flip between.
+type Board struct {
+	GuildID    string
+	ChannelID  string
+	MessageID  string
+	Collection *SoundCollection
+	Created    time.Time
+
+	page      int
+	responder Responder
+	sync.Mutex
+}
+
+var (
+	// Reactions for the sounds on a page, filled with regional indicator letters on startup
+	BOARD_EMOJI = make([]string, 0, 18)
+
+	// Reactions that flip between pages
+	BOARD_PREV = "⬅️"
+	BOARD_NEXT = "➡️"
+
+	// Boards stop responding after this long, so old messages don't pile up in memory
+	BOARD_LIFETIME = time.Hour * 12
+
+	// Active boards, keyed by message id
+	boards      = make(map[string]*Board)
+	boardsMutex sync.Mutex
+)
+
+func init() {
+	for i := 0; i < cap(BOARD_EMOJI); i++ {
+		BOARD_EMOJI = append(BOARD_EMOJI, string(rune(0x1F1E6+i)))
+	}
+}
+
+func (b *Board) Pages() int {
+	return (len(b.Collection.Sounds) + len(BOARD_EMOJI) - 1) / len(BOARD_EMOJI)
+}
+
+// The sound a reaction maps to on the current page, or nil
+func (b *Board) Sound(emoji string) *Sound {
+	for i, e := range BOARD_EMOJI {
+		if e == emoji {
+			index := b.page*len(BOARD_EMOJI) + i
+			if index < len(b.Collection.Sounds) {
+				return b.Collection.Sounds[index]
+			}
+		}
+	}
+	return nil
+}
+
+// Renders the current page of the board
+func (b *Board) String() string {
+	lines := []string{fmt.Sprintf("**%s soundboard** (page %d/%d), react to play a sound:", b.Collection.Commands[0], b.page+1, b.Pages())}
+
+	start := b.page * len(BOARD_EMOJI)
+	for i, sound := range b.Collection.Sounds[start:] {
+		if i >= len(BOARD_EMOJI) {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s `%s`", BOARD_EMOJI[i], sound.Name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Moves the board by a number of pages (wrapping around) and redraws it
+func (b *Board) Turn(by int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.page = (b.page + by + b.Pages()) % b.Pages()
+	if _, err := b.responder.Edit(b.MessageID, b.String()); err != nil {
+		log.WithFields(log.Fields{
+			"channel": b.ChannelID,
+			"message": b.MessageID,
+			"error":   err,
+		}).Warning("Failed to update soundboard")
+	}
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:     "board",
+		Args:     "<category>",
+		Help:     "Posts a soundboard you play by reacting to it",
+		Cooldown: time.Second * 10,
+		Run:      handleBoardCommand,
+	})
+}
+
+// Handles `!board <category>`, posting a soundboard for the collection
+func handleBoardCommand(c *CommandContext) error {
+	args := c.Args
+	if len(args) == 0 {
+		return errors.New("Which category? Try `!board airhorn`.")
+	}
+
+	coll := findGuildCollection(c.settings(), args[0])
+	if coll == nil {
+		return fmt.Errorf("I don't have a category called **%s**, try `!help`.", args[0])
+	}
+
+	board := &Board{
+		GuildID:    c.Guild.ID,
+		ChannelID:  c.ChannelID,
+		Collection: coll,
+		Created:    time.Now(),
+		responder:  c.Responder,
+	}
+
+	msg, err := c.Reply(board.String())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"channel": c.ChannelID,
+			"error":   err,
+		}).Warning("Failed to post soundboard")
+		return nil
+	}
+	board.MessageID = msg.ID
+
+	boardsMutex.Lock()
+	for id, old := range boards {
+		if time.Since(old.Created) > BOARD_LIFETIME {
+			delete(boards, id)
+		}
+	}
+	boards[msg.ID] = board
+	boardsMutex.Unlock()
+
+	reactions := BOARD_EMOJI
+	if len(coll.Sounds) < len(reactions) {
+		reactions = reactions[:len(coll.Sounds)]
+	}
+
+	if board.Pages() > 1 {
+		reactions = append([]string{BOARD_PREV}, append(reactions, BOARD_NEXT)...)
+	}
+	c.React(msg.ID, reactions...)
+	return nil
+}
+
+// Adds reactions to a message in order, giving up at the first one that fails
+func addReactions(s *discordgo.Session, channelID, messageID string, reactions []string) {
+	for _, emoji := range reactions {
+		if err := s.MessageReactionAdd(channelID, messageID, emoji); err != nil {
+			log.WithFields(log.Fields{
+				"channel": channelID,
+				"message": messageID,
+				"error":   err,
+			}).Warning("Failed to add reaction")
+			return
+		}
+	}
+}
+
+// Plays sounds (or flips pages) when someone reacts to a soundboard, and flips the pages of help
+func onMessageReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.UserID == s.State.Ready.User.ID {
+		return
+	}
+
+	// Only the process that sent a help message knows about it, so there's no shard to check
+	if help := findHelpMessage(r.MessageID); help != nil {
+		if r.GuildID != "" {
+			s.MessageReactionRemove(r.ChannelID, r.MessageID, r.Emoji.Name, r.UserID)
+		}
+		help.React(r.Emoji.Name)
+		return
+	}
+
+	boardsMutex.Lock()
+	board := boards[r.MessageID]
+	boardsMutex.Unlock()
+
+	if board == nil || time.Since(board.Created) > BOARD_LIFETIME || !shardContains(board.GuildID) {
+		return
+	}
+
+	// Take the reaction back off so it can be clicked again
+	s.MessageReactionRemove(r.ChannelID, r.MessageID, r.Emoji.Name, r.UserID)
+
+	switch emoji := r.Emoji.Name; {
+	case sameEmoji(emoji, BOARD_PREV):
+		board.Turn(-1)
+	case sameEmoji(emoji, BOARD_NEXT):
+		board.Turn(1)
+	default:
+		board.Lock()
+		sound := board.Sound(emoji)
+		board.Unlock()
+
+		guild, _ := s.State.Guild(board.GuildID)
+		member, _ := s.State.Member(board.GuildID, r.UserID)
+		if sound == nil || guild == nil || member == nil || member.User == nil {
+			return
+		}
+
+		play, err := preparePlay(s.State, member.User, guild, nil, board.Collection, sound)
+		if err == nil {
+			play.tag("board")
+			_, err = enqueuePlay(play)
+		}
+
+		if err != nil {
+			explain(r.ChannelID, r.UserID, err)
+		}
+	}
+}
+
+// Compares two unicode emoji, ignoring the variation selector discord sometimes adds or strips
+func sameEmoji(a, b string) bool {
+	return strings.TrimSuffix(a, "\ufe0f") == strings.TrimSuffix(b, "\ufe0f")
+}
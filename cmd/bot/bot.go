@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,12 +14,15 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
 	redis "gopkg.in/redis.v3"
 )
 
@@ -31,12 +36,62 @@ var (
 	// Map of Guild id's to *Play channels, used for queuing and rate-limiting guilds
 	queues map[string]chan *Play = make(map[string]chan *Play)
 
+	// Guards the queues map, plays are enqueued from many handler goroutines
+	queuesMutex sync.Mutex
+
+	// What each guild is playing and has waiting in its queue, so people can see it. Also
+	// guarded by queuesMutex.
+	nowPlaying  map[string]*Play   = make(map[string]*Play)
+	waitingPlay map[string][]*Play = make(map[string][]*Play)
+
 	// Sound encoding settings
 	BITRATE        = 128
 	MAX_QUEUE_SIZE = 6
 
-	// Owner
-	OWNER string
+	// Most sounds a single command can chain together (including repeats)
+	MAX_CHAIN_LENGTH = 10
+
+	// How long to stay in voice after the queue empties (0 leaves right away)
+	IDLE_TIMEOUT time.Duration
+
+	// How often an idle voice connection checks for humans and a dropped connection
+	VOICE_CHECK_INTERVAL = time.Second * 5
+
+	// How long a single voice frame may take to send before the connection is considered dead
+	SEND_TIMEOUT = time.Second
+
+	// Voice joins are attempted this many times, doubling the delay between each attempt
+	JOIN_ATTEMPTS = 4
+	JOIN_BACKOFF  = time.Millisecond * 500
+
+	// Returned when a voice frame could not be sent within SEND_TIMEOUT
+	ErrSendTimeout = errors.New("timed out sending voice frame")
+
+	// User facing reasons a play was rejected or dropped
+	ErrNotInVoice   = errors.New("You need to be in a voice channel, or name one like `!airhorn #General`.")
+	ErrQueueFull    = errors.New("The queue is full, give it a second.")
+	ErrShuttingDown = errors.New("I'm restarting, try again in a minute.")
+	ErrVoiceJoin    = errors.New("I couldn't join that voice channel, try again in a bit.")
+	ErrVoiceDropped = errors.New("I lost the voice connection, so I dropped the queue.")
+
+	// How long shutdown waits for queued sounds to finish before cutting them off
+	SHUTDOWN_TIMEOUT = time.Second * 15
+
+	// Set to 1 once shutdown has started, after which no new plays are accepted
+	shuttingDown int32
+
+	// Closed when shutdown starts, so idle voice connections stop waiting around
+	shutdownStarted = make(chan struct{})
+
+	// Cancelled when the shutdown deadline passes, stopping anything still playing
+	playbackCtx, stopPlayback = context.WithCancel(context.Background())
+
+	// Playback goroutines, waited on before stats are flushed so none of them can start a
+	// stats write while we're waiting for the others
+	playbackRoutines sync.WaitGroup
+
+	// Stats writes still in flight, flushed before redis is closed
+	pendingStats sync.WaitGroup
 
 	// Shard (or -1)
 	SHARDS []string = make([]string, 0)
@@ -49,11 +104,56 @@ type Play struct {
 	UserID    string
 	Sound     *Sound
 
+	// The collection the sound belongs to
+	Collection *SoundCollection
+
 	// The next play to occur after this, only used for chaining sounds like anotha
 	Next *Play
 
 	// If true, this was a forced play using a specific airhorn sound name
 	Forced bool
+
+	// The message that asked for this play, used to report problems back (nil if none)
+	Message *discordgo.Message
+
+	// Where this play came from when it wasn't a sound command, eg "intro", tracked in stats
+	Source string
+
+	// Frames of the sound to play, an End of 0 plays to the end of the sound
+	Start int
+	End   int
+}
+
+// Chains another sound from a collection (a random one if sound is nil) onto the end of this
+// play, returning the new play
+func (p *Play) Append(coll *SoundCollection, sound *Sound) *Play {
+	last := p
+	for last.Next != nil {
+		last = last.Next
+	}
+
+	last.Next = &Play{
+		GuildID:    p.GuildID,
+		ChannelID:  p.ChannelID,
+		UserID:     p.UserID,
+		Sound:      sound,
+		Collection: coll,
+		Forced:     true,
+		Source:     p.Source,
+	}
+
+	if sound == nil {
+		last.Next.Sound = coll.Random()
+		last.Next.Forced = false
+	}
+	return last.Next
+}
+
+// Tags a play, and anything chained after it, with where it came from
+func (p *Play) tag(source string) {
+	for ; p != nil; p = p.Next {
+		p.Source = source
+	}
 }
 
 type SoundCollection struct {
@@ -62,28 +162,58 @@ type SoundCollection struct {
 	Sounds    []*Sound
 	ChainWith *SoundCollection
 
-	soundRange int
-}
+	// Where the sounds are from, like a show or video
+	Source string
 
-type CommandCollection struct {
-	Commands  []string
-}
+	// NSFW collections can be hidden by guilds that don't want them
+	NSFW bool
+
+	// Collections can be switched on and off by the owner at runtime, this sets whether the
+	// collection starts switched off before anyone has touched it
+	DisabledByDefault bool
 
+	soundRange int
+	enabled    int32
+}
 
 // Sound represents a sound clip
 type Sound struct {
 	Name string
 
+	// What the sound is, shown in help and search
+	Description string
+
+	// Where it's from, like a show or video, if it's not the same as its collection
+	Source string
+
+	// What's said in it, searched by !quote
+	Transcript string
+
+	// Who added it to the catalog, and when
+	AddedBy string
+	Added   time.Time
+
 	// Weight adjust how likely it is this song will play, higher = more likely
 	Weight int
 
 	// Delay (in milliseconds) for the bot to wait before sending the disconnect request
 	PartDelay int
 
+	// Minimum time between two plays of this sound in the same guild
+	Cooldown time.Duration
+
 	// Buffer to store encoded PCM packets
 	buffer [][]byte
+
+	// Excerpts are cut out of another sound in the same collection instead of loaded from disk
+	excerptOf    string
+	excerptStart time.Duration
+	excerptEnd   time.Duration
 }
 
+// Each encoded packet in a sound buffer holds this much audio
+const FRAME_DURATION = time.Millisecond * 20
+
 // Array of all the sounds we have
 var AIRHORN *SoundCollection = &SoundCollection{
 	Prefix: "airhorn",
@@ -91,20 +221,20 @@ var AIRHORN *SoundCollection = &SoundCollection{
 		"!airhorn",
 	},
 	Sounds: []*Sound{
-		createSound("default", 1000, 250),
-		createSound("reverb", 800, 250),
-		createSound("spam", 800, 0),
-		createSound("tripletap", 800, 250),
-		createSound("fourtap", 800, 250),
-		createSound("distant", 500, 250),
-		createSound("echo", 500, 250),
-		createSound("clownfull", 250, 250),
-		createSound("clownshort", 250, 250),
-		createSound("clownspam", 250, 0),
+		createSound("default", 1000, 250).Describe("The classic airhorn"),
+		createSound("reverb", 800, 250).Describe("An airhorn in a big room"),
+		createSound("spam", 800, 0).Describe("Lots of quick airhorns"),
+		createSound("tripletap", 800, 250).Describe("Three quick airhorns"),
+		createSound("fourtap", 800, 250).Describe("Four quick airhorns"),
+		createSound("distant", 500, 250).Describe("An airhorn far away"),
+		createSound("echo", 500, 250).Describe("An airhorn with an echo"),
+		createSound("clownfull", 250, 250).Describe("A clown horn"),
+		createSound("clownshort", 250, 250).Describe("A quick clown horn"),
+		createSound("clownspam", 250, 0).Describe("Lots of clown horns"),
 		createSound("highfartlong", 200, 250),
 		createSound("highfartshort", 200, 250),
 		createSound("midshort", 100, 250),
-		createSound("truck", 50, 250),
+		createSound("truck", 50, 250).Describe("A truck horn"),
 		createSound("spork", 25, 250),
 	},
 }
@@ -206,6 +336,7 @@ var DECTALK *SoundCollection = &SoundCollection{
 		createSound("space", 100, 250),
 		createSound("spooky", 100, 250),
 		createSound("trolo", 25, 250),
+		createExcerpt("trolohook", "trolo", time.Second*5, time.Second*12, 25, 250),
 		createSound("whalers", 75, 250),
 	},
 }
@@ -350,6 +481,7 @@ var JONTRON *SoundCollection = &SoundCollection{
 		createSound("notgonnawork", 40, 250),
 		createSound("spaceace", 100, 250),
 	},
+	Source: "JonTron",
 }
 
 var JURASSIC *SoundCollection = &SoundCollection{
@@ -424,11 +556,12 @@ var PENIS *SoundCollection = &SoundCollection{
 		createSound("floppy", 100, 250),
 		createSound("have", 100, 250),
 		createSound("holy", 50, 250),
-		createSound("jerk", 10, 250),
+		createSound("jerk", 10, 250).Limit(time.Hour),
 		createSound("kick", 100, 250),
 		createSound("love", 100, 250),
 		createSound("talk", 100, 250),
 	},
+	NSFW: true,
 }
 
 var RANKUP *SoundCollection = &SoundCollection{
@@ -459,21 +592,22 @@ var RET *SoundCollection = &SoundCollection{
 	},
 }
 
-// Disabled because volume too loud right now.
-//var SANIC *SoundCollection = &SoundCollection{
-//	Prefix: "sanic",
-//	Commands: []string{
-//		"!sanic",		
-//	},
-//	Sounds: []*Sound{
-//		createSound("damnit", 100, 250),
-//		createSound("faster", 100, 250),
-//		createSound("go", 100, 250),
-//		createSound("jesus", 100, 250),
-//		createSound("mph", 100, 250),
-//		createSound("slow", 100, 250),
-//	},
-//}
+// Too loud right now, so it starts switched off until the owner runs `@bot enable sanic`
+var SANIC *SoundCollection = &SoundCollection{
+	Prefix: "sanic",
+	Commands: []string{
+		"!sanic",
+	},
+	Sounds: []*Sound{
+		createSound("damnit", 100, 250),
+		createSound("faster", 100, 250),
+		createSound("go", 100, 250),
+		createSound("jesus", 100, 250),
+		createSound("mph", 100, 250),
+		createSound("slow", 100, 250),
+	},
+	DisabledByDefault: true,
+}
 
 var SBEMAIL *SoundCollection = &SoundCollection{
 	Prefix: "sbemail",
@@ -494,6 +628,7 @@ var SBEMAIL *SoundCollection = &SoundCollection{
 		createSound("thanks", 100, 250),
 		createSound("jimmy", 50, 250),
 	},
+	Source: "Homestar Runner",
 }
 
 var SEALAB *SoundCollection = &SoundCollection{
@@ -520,6 +655,7 @@ var SEALAB *SoundCollection = &SoundCollection{
 		createSound("teleport", 100, 250),
 		createSound("why", 100, 250),
 	},
+	Source: "Sealab 2021",
 }
 
 var SIMPSONS *SoundCollection = &SoundCollection{
@@ -533,6 +669,7 @@ var SIMPSONS *SoundCollection = &SoundCollection{
 		createSound("haha", 100, 250),
 		createSound("no", 100, 250),
 	},
+	Source: "The Simpsons",
 }
 
 var SNOOP *SoundCollection = &SoundCollection{
@@ -607,6 +744,8 @@ var SOUTHPARK *SoundCollection = &SoundCollection{
 		createSound("pwnage", 100, 250),
 		createSound("pwned", 100, 250),
 	},
+	Source: "South Park",
+	NSFW:   true,
 }
 
 var STRATEGY *SoundCollection = &SoundCollection{
@@ -682,20 +821,7 @@ var WTF *SoundCollection = &SoundCollection{
 		createSound("youdoing", 100, 250),
 		createSound("yousaid", 25, 250),
 	},
-}
-
-var CMDHELP *CommandCollection = &CommandCollection{
-	Commands: []string{
-		"!help",
-		
-	},
-}
-
-var CMDCOLORME *CommandCollection = &CommandCollection{
-	Commands: []string{
-		"!colorme",
-		
-	},
+	NSFW: true,
 }
 
 var COLLECTIONS []*SoundCollection = []*SoundCollection{
@@ -726,6 +852,7 @@ var COLLECTIONS []*SoundCollection = []*SoundCollection{
 	PENIS,
 	RANKUP,
 	RET,
+	SANIC,
 	SBEMAIL,
 	SEALAB,
 	SIMPSONS,
@@ -739,10 +866,6 @@ var COLLECTIONS []*SoundCollection = []*SoundCollection{
 	WTF,
 }
 
-var BOTCOMMANDS []*CommandCollection = []*CommandCollection{
-	CMDHELP, CMDCOLORME,
-}
-
 // Create a Sound struct
 func createSound(Name string, Weight int, PartDelay int) *Sound {
 	return &Sound{
@@ -753,10 +876,100 @@ func createSound(Name string, Weight int, PartDelay int) *Sound {
 	}
 }
 
+// Sets what the sound is, returning the sound so it can go straight in a catalog
+func (s *Sound) Describe(description string) *Sound {
+	s.Description = description
+	return s
+}
+
+// Limits how often the sound can play in a guild, like Describe
+func (s *Sound) Limit(cooldown time.Duration) *Sound {
+	s.Cooldown = cooldown
+	return s
+}
+
+// Finds a collection by its prefix or one of its commands (with or without the !)
+func findCollection(name string) *SoundCollection {
+	name = strings.TrimPrefix(strings.ToLower(name), "!")
+	for _, coll := range COLLECTIONS {
+		if coll.Prefix == name || scontains("!"+name, coll.Commands...) {
+			return coll
+		}
+	}
+	return nil
+}
+
+// Finds a sound in this collection by name
+func (sc *SoundCollection) Find(name string) *Sound {
+	for _, sound := range sc.Sounds {
+		if sound.Name == name {
+			return sound
+		}
+	}
+	return nil
+}
+
+// Create a Sound that plays part of another sound in the same collection
+func createExcerpt(Name string, Of string, Start, End time.Duration, Weight int, PartDelay int) *Sound {
+	sound := createSound(Name, Weight, PartDelay)
+	sound.excerptOf = Of
+	sound.excerptStart = Start
+	sound.excerptEnd = End
+	return sound
+}
+
+// Whether the collection is switched on
+func (sc *SoundCollection) Enabled() bool {
+	return atomic.LoadInt32(&sc.enabled) == 1
+}
+
+func (sc *SoundCollection) SetEnabled(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&sc.enabled, value)
+}
+
+// Collections that are switched on
+func enabledCollections() []*SoundCollection {
+	colls := make([]*SoundCollection, 0, len(COLLECTIONS))
+	for _, coll := range COLLECTIONS {
+		if coll.Enabled() {
+			colls = append(colls, coll)
+		}
+	}
+	return colls
+}
+
 func (sc *SoundCollection) Load() {
+	sc.SetEnabled(!sc.DisabledByDefault)
+
 	for _, sound := range sc.Sounds {
 		sc.soundRange += sound.Weight
-		sound.Load(sc)
+		if sound.excerptOf == "" {
+			sound.Load(sc)
+		}
+	}
+
+	// Excerpts share their parent's buffer, so they can only be cut once it's loaded
+	for _, sound := range sc.Sounds {
+		if sound.excerptOf == "" {
+			continue
+		}
+
+		parent := sc.Find(sound.excerptOf)
+		if parent == nil {
+			log.WithFields(log.Fields{
+				"collection": sc.Prefix,
+				"sound":      sound.Name,
+				"excerptOf":  sound.excerptOf,
+			}).Warning("Excerpt of a sound that doesn't exist")
+			continue
+		}
+
+		start, end := parent.frames(sound.excerptStart, sound.excerptEnd)
+		sound.buffer = parent.buffer[start:end]
 	}
 }
 
@@ -822,27 +1035,194 @@ func (s *Sound) Load(c *SoundCollection) error {
 	}
 }
 
+// How long this sound plays for
+func (s *Sound) Duration() time.Duration {
+	return FRAME_DURATION * time.Duration(len(s.buffer))
+}
+
+// Converts a time range of this sound into a range of frames, clamped to the sound's length.
+// An end of 0 means the end of the sound.
+func (s *Sound) frames(start, end time.Duration) (int, int) {
+	first, last := int(start/FRAME_DURATION), int(end/FRAME_DURATION)
+	if end == 0 || last > len(s.buffer) {
+		last = len(s.buffer)
+	}
+
+	if first > last {
+		first = last
+	}
+	return first, last
+}
+
 // Plays this sound over the specified VoiceConnection
-func (s *Sound) Play(vc *discordgo.VoiceConnection) {
+func (s *Sound) Play(ctx context.Context, vc *discordgo.VoiceConnection) error {
+	return s.PlayFrames(ctx, vc, 0, 0)
+}
+
+// How long a play of frames [start, end) of this sound lasts, with the same defaults as PlayFrames
+func (s *Sound) FramesDuration(start, end int) time.Duration {
+	if end <= 0 || end > len(s.buffer) {
+		end = len(s.buffer)
+	}
+
+	if start > end {
+		start = end
+	}
+	return FRAME_DURATION * time.Duration(end-start)
+}
+
+// Plays frames [start, end) of this sound over the specified VoiceConnection, an end of 0 plays
+// to the end of the sound. Playback stops early if the context is cancelled or a frame can't be
+// sent within SEND_TIMEOUT, which means the connection is dead.
+func (s *Sound) PlayFrames(ctx context.Context, vc *discordgo.VoiceConnection, start, end int) error {
+	if end <= 0 || end > len(s.buffer) {
+		end = len(s.buffer)
+	}
+
+	if start > end {
+		start = end
+	}
+
 	vc.Speaking(true)
 	defer vc.Speaking(false)
 
-	for _, buff := range s.buffer {
-		vc.OpusSend <- buff
+	timeout := time.NewTimer(SEND_TIMEOUT)
+	defer timeout.Stop()
+
+	for _, buff := range s.buffer[start:end] {
+		if !timeout.Stop() {
+			select {
+			case <-timeout.C:
+			default:
+			}
+		}
+		timeout.Reset(SEND_TIMEOUT)
+
+		select {
+		case vc.OpusSend <- buff:
+		case <-timeout.C:
+			return ErrSendTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return nil
 }
 
 // Attempts to find the current users voice channel inside a given guild
-func getCurrentVoiceChannel(user *discordgo.User, guild *discordgo.Guild) *discordgo.Channel {
+func getCurrentVoiceChannel(state *discordgo.State, user *discordgo.User, guild *discordgo.Guild) *discordgo.Channel {
 	for _, vs := range guild.VoiceStates {
 		if vs.UserID == user.ID {
-			channel, _ := discord.State.Channel(vs.ChannelID)
+			channel, _ := state.Channel(vs.ChannelID)
+			return channel
+		}
+	}
+	return nil
+}
+
+// Checks that a user (or the bot itself) can connect to and speak in a voice channel
+func checkVoicePermissions(state *discordgo.State, userID string, channel *discordgo.Channel) error {
+	perms, err := state.UserChannelPermissions(userID, channel.ID)
+	if err != nil {
+		return fmt.Errorf("I couldn't check permissions for **%s**.", channel.Name)
+	}
+
+	if userID == state.Ready.User.ID {
+		if perms&discordgo.PermissionVoiceConnect == 0 || perms&discordgo.PermissionVoiceSpeak == 0 {
+			return fmt.Errorf("I need the Connect and Speak permissions in **%s**.", channel.Name)
+		}
+	} else if perms&discordgo.PermissionVoiceConnect == 0 {
+		return fmt.Errorf("You don't have permission to join **%s**.", channel.Name)
+	}
+	return nil
+}
+
+// Pulls a target voice channel out of a commands arguments. Targets can be a channel mention,
+// a #channel-name or a user mention (meaning whichever channel that user is in). The remaining
+// arguments are returned, along with a nil channel if no target was given.
+func findTargetChannel(state *discordgo.State, m *discordgo.MessageCreate, guild *discordgo.Guild, args []string) (*discordgo.Channel, []string, error) {
+	for i, arg := range args {
+		var (
+			channel *discordgo.Channel
+			rest    = append(append([]string{}, args[:i]...), args[i+1:]...)
+		)
+
+		switch {
+		case strings.HasPrefix(arg, "<#") && strings.HasSuffix(arg, ">"):
+			channel, _ = state.Channel(arg[2 : len(arg)-1])
+			if channel == nil || channel.GuildID != guild.ID || channel.Type != discordgo.ChannelTypeGuildVoice {
+				return nil, nil, errors.New("That's not a voice channel on this server.")
+			}
+		case strings.HasPrefix(arg, "<@") && strings.HasSuffix(arg, ">"):
+			userID := strings.TrimPrefix(arg[2:len(arg)-1], "!")
+			var target *discordgo.User
+			for _, mention := range m.Mentions {
+				if mention.ID == userID {
+					target = mention
+				}
+			}
+
+			if target == nil {
+				continue
+			}
+
+			channel = getCurrentVoiceChannel(state, target, guild)
+			if channel == nil {
+				return nil, nil, fmt.Errorf("**%s** isn't in a voice channel.", target.Username)
+			}
+		case strings.HasPrefix(arg, "#") && len(arg) > 1:
+			// Channel names can have spaces, so try the longest run of arguments first
+			for j := len(args); j > i && channel == nil; j-- {
+				channel = findVoiceChannelByName(guild, strings.Join(args[i:j], " ")[1:])
+				rest = append(append([]string{}, args[:i]...), args[j:]...)
+			}
+
+			if channel == nil {
+				return nil, nil, fmt.Errorf("I couldn't find a voice channel called **%s**.", arg[1:])
+			}
+		default:
+			continue
+		}
+
+		if err := checkVoicePermissions(state, m.Author.ID, channel); err != nil {
+			return nil, nil, err
+		}
+		return channel, rest, nil
+	}
+	return nil, args, nil
+}
+
+// Finds a voice channel in a guild by (case insensitive) name
+func findVoiceChannelByName(guild *discordgo.Guild, name string) *discordgo.Channel {
+	for _, channel := range guild.Channels {
+		if channel.Type == discordgo.ChannelTypeGuildVoice && strings.EqualFold(channel.Name, name) {
 			return channel
 		}
 	}
 	return nil
 }
 
+// Whether anyone other than a bot is connected to a voice channel
+func channelHasHumans(state *discordgo.State, guildID, channelID string) bool {
+	guild, _ := state.Guild(guildID)
+	if guild == nil {
+		return false
+	}
+
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID != channelID || vs.UserID == state.Ready.User.ID {
+			continue
+		}
+
+		member, _ := state.Member(guildID, vs.UserID)
+		if member != nil && member.User != nil && member.User.Bot {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
 // Whether a guild id is in this shard
 func shardContains(guildid string) bool {
 	if len(SHARDS) != 0 {
@@ -858,6 +1238,128 @@ func shardContains(guildid string) bool {
 	return true
 }
 
+// The ids of every guild we know about in this shard
+func shardGuildIDs() []string {
+	discord.State.RLock()
+	defer discord.State.RUnlock()
+
+	ids := make([]string, 0, len(discord.State.Guilds))
+	for _, guild := range discord.State.Guilds {
+		if shardContains(guild.ID) {
+			ids = append(ids, guild.ID)
+		}
+	}
+	return ids
+}
+
+// A sound asked for in a command (nil for a random one), and the part of it to play
+type soundRequest struct {
+	Sound *Sound
+	Start time.Duration
+	End   time.Duration
+}
+
+// Parses the sounds asked for in a command, eg `default spam x3 truck 0:01-0:02`. An xN repeats
+// the sound before it (or a random one if it comes first) and a time range applies to the sound
+// before it. Sound names win over repeats, so `!cow x3` still plays the x3 sound.
+func parseSoundRequests(coll *SoundCollection, args []string) ([]*soundRequest, error) {
+	requests := make([]*soundRequest, 0, len(args))
+
+	for _, arg := range args {
+		arg = strings.ToLower(arg)
+		if sound := coll.Find(arg); sound != nil {
+			requests = append(requests, &soundRequest{Sound: sound})
+		} else if count, err := strconv.Atoi(strings.TrimPrefix(arg, "x")); err == nil && strings.HasPrefix(arg, "x") {
+			if len(requests) == 0 {
+				requests = append(requests, &soundRequest{})
+			}
+
+			if count < 1 || len(requests)+count-1 > MAX_CHAIN_LENGTH {
+				return nil, fmt.Errorf("I can only play %d sounds at once.", MAX_CHAIN_LENGTH)
+			}
+
+			last := requests[len(requests)-1]
+			for i := 1; i < count; i++ {
+				repeat := *last
+				requests = append(requests, &repeat)
+			}
+		} else if strings.ContainsAny(arg, "-:") {
+			// A range needs a sound before it, a random one could be any length
+			if len(requests) == 0 || requests[len(requests)-1].Sound == nil {
+				return nil, errors.New("Pick a sound to play part of, like `!dectalk trolo 0:05-0:12`.")
+			}
+
+			last := requests[len(requests)-1]
+
+			last.Start, last.End, err = parseTimeRange(arg)
+			if err == nil && last.Start >= last.Sound.Duration() {
+				err = fmt.Errorf("**%s** is only %s long.", last.Sound.Name, formatTimestamp(last.Sound.Duration()))
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("I don't have a sound called **%s**, try `!help %s`.", arg, coll.Commands[0][1:])
+		}
+
+		if len(requests) > MAX_CHAIN_LENGTH {
+			return nil, fmt.Errorf("I can only play %d sounds at once.", MAX_CHAIN_LENGTH)
+		}
+	}
+
+	// No arguments means a random sound
+	if len(requests) == 0 {
+		requests = append(requests, &soundRequest{})
+	}
+	return requests, nil
+}
+
+// Parses a time range of a sound like `0:05-0:12`, `5-12.5` or `1:30-` (to the end)
+func parseTimeRange(arg string) (start, end time.Duration, err error) {
+	bounds := strings.SplitN(arg, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("**%s** isn't a time range, try something like `0:05-0:12`.", arg)
+	}
+
+	if start, err = parseTimestamp(bounds[0]); err == nil {
+		end, err = parseTimestamp(bounds[1])
+	}
+
+	if err != nil || (end != 0 && end <= start) {
+		return 0, 0, fmt.Errorf("**%s** isn't a time range, try something like `0:05-0:12`.", arg)
+	}
+	return start, end, nil
+}
+
+// Parses a timestamp like `1:05`, `65` or `1:05.5`, an empty timestamp is 0
+func parseTimestamp(ts string) (time.Duration, error) {
+	if ts == "" {
+		return 0, nil
+	}
+
+	var minutes int
+	if i := strings.Index(ts, ":"); i >= 0 {
+		var err error
+		if minutes, err = strconv.Atoi(ts[:i]); err != nil || minutes < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		ts = ts[i+1:]
+	}
+
+	seconds, err := strconv.ParseFloat(ts, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid timestamp %q", ts)
+	}
+	return time.Minute*time.Duration(minutes) + time.Duration(seconds*float64(time.Second)), nil
+}
+
+// Formats a duration as a timestamp like `1:05`
+func formatTimestamp(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
 // Returns a random integer between min and max
 func randomRange(min, max int) int {
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -867,7 +1369,7 @@ func randomRange(min, max int) int {
 // Prepares a play
 func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound) *Play {
 	// Grab the users voice channel
-	channel := getCurrentVoiceChannel(user, guild)
+	channel := getCurrentVoiceChannel(discord.State, user, guild)
 	if channel == nil {
 		log.WithFields(log.Fields{
 			"user":  user.ID,
@@ -876,13 +1378,19 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 		return nil
 	}
 
+	return createPlayInChannel(user, guild, channel, coll, sound)
+}
+
+// Prepares a play in a specific voice channel
+func createPlayInChannel(user *discordgo.User, guild *discordgo.Guild, channel *discordgo.Channel, coll *SoundCollection, sound *Sound) *Play {
 	// Create the play
 	play := &Play{
-		GuildID:   guild.ID,
-		ChannelID: channel.ID,
-		UserID:    user.ID,
-		Sound:     sound,
-		Forced:    true,
+		GuildID:    guild.ID,
+		ChannelID:  channel.ID,
+		UserID:     user.ID,
+		Sound:      sound,
+		Collection: coll,
+		Forced:     true,
 	}
 
 	// If we didn't get passed a manual sound, generate a random one
@@ -894,36 +1402,119 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 	// If the collection is a chained one, set the next sound
 	if coll.ChainWith != nil {
 		play.Next = &Play{
-			GuildID:   play.GuildID,
-			ChannelID: play.ChannelID,
-			UserID:    play.UserID,
-			Sound:     coll.ChainWith.Random(),
-			Forced:    play.Forced,
+			GuildID:    play.GuildID,
+			ChannelID:  play.ChannelID,
+			UserID:     play.UserID,
+			Sound:      coll.ChainWith.Random(),
+			Collection: coll.ChainWith,
+			Forced:     play.Forced,
 		}
 	}
 
 	return play
 }
 
-// Prepares and enqueues a play into the ratelimit/buffer guild queue
-func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound) {
-	play := createPlay(user, guild, coll, sound)
-	if play == nil {
-		return
+// Prepares a play for a user, checking it can actually happen. If channel is nil the sound
+// plays in the users current voice channel.
+func preparePlay(state *discordgo.State, user *discordgo.User, guild *discordgo.Guild, channel *discordgo.Channel, coll *SoundCollection, sound *Sound) (*Play, error) {
+	if channel == nil {
+		channel = getCurrentVoiceChannel(state, user, guild)
+		if channel == nil {
+			return nil, ErrNotInVoice
+		}
+	}
+
+	if err := checkVoicePermissions(state, state.Ready.User.ID, channel); err != nil {
+		return nil, err
+	}
+
+	return createPlayInChannel(user, guild, channel, coll, sound), nil
+}
+
+// Enqueues a play into the ratelimit/buffer guild queue, starting playback if the guild has
+// nothing playing. Returns whether the play had to wait behind others.
+func enqueuePlay(play *Play) (queued bool, err error) {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return false, ErrShuttingDown
+	}
+
+	// Policies look up settings and roles, so they're checked before taking the lock every
+	// guild's playback shares. Their cooldowns are given back if the play can't be queued.
+	release, err := applyPolicies(play)
+	if err != nil {
+		return false, err
 	}
 
 	// Check if we already have a connection to this guild
-	//   yes, this isn't threadsafe, but its "OK" 99% of the time
-	_, exists := queues[guild.ID]
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+
+	// Shutdown may have started while we waited for the lock, and once it has no more playback
+	// can start
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		release()
+		return false, ErrShuttingDown
+	}
+
+	queue, exists := queues[play.GuildID]
+	if exists && len(queue) >= MAX_QUEUE_SIZE {
+		release()
+		return false, ErrQueueFull
+	}
 
 	if exists {
-		if len(queues[guild.ID]) < MAX_QUEUE_SIZE {
-			queues[guild.ID] <- play
-		}
-	} else {
-		queues[guild.ID] = make(chan *Play, MAX_QUEUE_SIZE)
-		playSound(play, nil)
+		waitingPlay[play.GuildID] = append(waitingPlay[play.GuildID], play)
+		queue <- play
+		return true, nil
+	}
+
+	queues[play.GuildID] = make(chan *Play, MAX_QUEUE_SIZE)
+	nowPlaying[play.GuildID] = play
+	playbackRoutines.Add(1)
+	go func() {
+		defer playbackRoutines.Done()
+		playSound(playbackCtx, play, nil)
+	}()
+	return false, nil
+}
+
+// Moves a play that was just taken off its guild's queue from waiting to playing. The caller
+// must hold queuesMutex.
+func startedPlayLocked(play *Play) {
+	if waiting := waitingPlay[play.GuildID]; len(waiting) > 0 {
+		waitingPlay[play.GuildID] = waiting[1:]
 	}
+	nowPlaying[play.GuildID] = play
+}
+
+func startedPlay(play *Play) *Play {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+	startedPlayLocked(play)
+	return play
+}
+
+// Forgets a guild's queue. The caller must hold queuesMutex.
+func deleteQueueLocked(guildID string) {
+	delete(queues, guildID)
+	delete(nowPlaying, guildID)
+	delete(waitingPlay, guildID)
+}
+
+// Returns what a guild is playing (nil if nothing) and what's waiting after it
+func guildQueue(guildID string) (*Play, []*Play) {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+	return nowPlaying[guildID], append([]*Play(nil), waitingPlay[guildID]...)
+}
+
+// Tracks stats for a play in the background, shutdown waits for these to finish
+func trackSoundStatsAsync(play *Play) {
+	pendingStats.Add(1)
+	go func() {
+		defer pendingStats.Done()
+		trackSoundStats(play)
+	}()
 }
 
 func trackSoundStats(play *Play) {
@@ -950,6 +1541,14 @@ func trackSoundStats(play *Play) {
 		pipe.SAdd(fmt.Sprintf("%s:users", base), play.UserID)
 		pipe.SAdd(fmt.Sprintf("%s:guilds", base), play.GuildID)
 		pipe.SAdd(fmt.Sprintf("%s:channels", base), play.ChannelID)
+
+		// Plays from somewhere other than a command also get counted under their source
+		if play.Source != "" {
+			source := fmt.Sprintf("airhorn:source:%s", play.Source)
+			pipe.Incr(fmt.Sprintf("%s:total", source))
+			pipe.Incr(fmt.Sprintf("%s:sound:%s", source, play.Sound.Name))
+			pipe.SAdd("airhorn:sources", play.Source)
+		}
 		return nil
 	})
 
@@ -960,61 +1559,223 @@ func trackSoundStats(play *Play) {
 	}
 }
 
-// Play a sound
-func playSound(play *Play, vc *discordgo.VoiceConnection) (err error) {
-	log.WithFields(log.Fields{
-		"play": play,
-	}).Info("Playing sound")
+// Play a sound, then keep playing from the guild queue until it runs dry
+func playSound(ctx context.Context, play *Play, vc *discordgo.VoiceConnection) (err error) {
+	for play != nil {
+		log.WithFields(log.Fields{
+			"play": play,
+		}).Info("Playing sound")
+
+		if vc == nil {
+			vc, err = joinVoice(ctx, play.GuildID, play.ChannelID)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"guild":   play.GuildID,
+					"channel": play.ChannelID,
+					"error":   err,
+				}).Error("Failed to play sound")
+				reject(play.Message, ErrVoiceJoin)
+				teardownQueue(play.GuildID, nil, ErrVoiceJoin)
+				return err
+			}
+		}
+
+		// If we need to change channels, do that now
+		if vc.ChannelID != play.ChannelID {
+			vc.ChangeChannel(play.ChannelID, false, false)
+			time.Sleep(time.Millisecond * 125)
+		}
+
+		// Track stats for this play in redis
+		trackSoundStatsAsync(play)
+
+		// Sleep for a specified amount of time before playing the sound
+		time.Sleep(time.Millisecond * 32)
+
+		// Play the sound, and if this is chained, the chained sounds
+		err = play.Sound.PlayFrames(ctx, vc, play.Start, play.End)
+		for next := play.Next; next != nil && err == nil; next = next.Next {
+			trackSoundStatsAsync(next)
+			err = next.Sound.PlayFrames(ctx, vc, next.Start, next.End)
+		}
 
-	if vc == nil {
-		vc, err = discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
-		// vc.Receive = false
 		if err != nil {
 			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("Failed to play sound")
-			delete(queues, play.GuildID)
+				"guild":   play.GuildID,
+				"channel": vc.ChannelID,
+				"sound":   play.Sound.Name,
+				"error":   err,
+			}).Error("Voice connection failed during playback")
+			teardownQueue(play.GuildID, vc, ErrVoiceDropped)
 			return err
 		}
+
+		play, vc = nextPlay(ctx, play, vc)
 	}
+	return nil
+}
 
-	// If we need to change channels, do that now
-	if vc.ChannelID != play.ChannelID {
-		vc.ChangeChannel(play.ChannelID, false, false)
-		time.Sleep(time.Millisecond * 125)
+// Drops everything queued for a guild, letting the requesters know why, and closes its voice
+// connection (if any)
+func teardownQueue(guildID string, vc *discordgo.VoiceConnection, reason error) {
+	queuesMutex.Lock()
+	queue := queues[guildID]
+	deleteQueueLocked(guildID)
+	queuesMutex.Unlock()
+
+	// Playback is only cancelled during shutdown, so that's why the queue is being dropped
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		reason = ErrShuttingDown
 	}
 
-	// Track stats for this play in redis
-	go trackSoundStats(play)
+	for len(queue) > 0 {
+		reject((<-queue).Message, reason)
+	}
 
-	// Sleep for a specified amount of time before playing the sound
-	time.Sleep(time.Millisecond * 32)
+	if vc != nil {
+		vc.Disconnect()
+	}
+}
+
+// Joins a voice channel, retrying failed attempts with exponential backoff
+func joinVoice(ctx context.Context, guildID, channelID string) (vc *discordgo.VoiceConnection, err error) {
+	backoff := JOIN_BACKOFF
 
-	// Play the sound
-	play.Sound.Play(vc)
+	for attempt := 1; ; attempt++ {
+		vc, err = discord.ChannelVoiceJoin(guildID, channelID, false, false)
+		if err == nil {
+			return vc, nil
+		}
 
-	// If this is chained, play the chained sound
-	if play.Next != nil {
-		playSound(play.Next, vc)
+		log.WithFields(log.Fields{
+			"guild":   guildID,
+			"channel": channelID,
+			"attempt": attempt,
+			"error":   err,
+		}).Warning("Failed to join voice channel")
+
+		if attempt >= JOIN_ATTEMPTS {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
 	}
+}
 
-	// If there is another song in the queue, recurse and play that
-	if len(queues[play.GuildID]) > 0 {
-		play := <-queues[play.GuildID]
-		playSound(play, vc)
-		return nil
+// Waits for the next play in the guild queue. With an idle timeout set (or a party going) the
+// voice connection is held open until it expires, the channel has no humans left, or the
+// connection can't be recovered. When nothing is left to play the queue is deleted and the
+// connection closed.
+func nextPlay(ctx context.Context, last *Play, vc *discordgo.VoiceConnection) (*Play, *discordgo.VoiceConnection) {
+	queuesMutex.Lock()
+	queue := queues[last.GuildID]
+	queuesMutex.Unlock()
+
+	idleSince := time.Now()
+	if voiceIdleDeadline(last.GuildID, idleSince).After(idleSince) && atomic.LoadInt32(&shuttingDown) == 0 {
+		check := time.NewTicker(VOICE_CHECK_INTERVAL)
+		defer check.Stop()
+
+	wait:
+		for {
+			select {
+			case play := <-queue:
+				return startedPlay(play), vc
+			case <-ctx.Done():
+				break wait
+			case <-shutdownStarted:
+				break wait
+			case <-check.C:
+				if time.Now().After(voiceIdleDeadline(last.GuildID, idleSince)) {
+					break wait
+				}
+
+				if !channelHasHumans(discord.State, last.GuildID, vc.ChannelID) {
+					break wait
+				}
+
+				if !voiceReady(vc) {
+					vc = rejoinVoice(ctx, vc)
+					if vc == nil {
+						break wait
+					}
+				}
+			}
+		}
+	} else {
+		select {
+		case play := <-queue:
+			return startedPlay(play), vc
+		default:
+		}
+		time.Sleep(time.Millisecond * time.Duration(last.Sound.PartDelay))
+	}
+
+	// If the queue is still empty, delete it
+	queuesMutex.Lock()
+	select {
+	case play := <-queue:
+		startedPlayLocked(play)
+		queuesMutex.Unlock()
+		return play, vc
+	default:
+	}
+	deleteQueueLocked(last.GuildID)
+	queuesMutex.Unlock()
+
+	if vc != nil {
+		vc.Disconnect()
 	}
+	return nil, nil
+}
+
+// When a guild's voice connection, idle since the given time, should leave. Parties keep it
+// around until they end.
+func voiceIdleDeadline(guildID string, idleSince time.Time) time.Time {
+	deadline := idleSince.Add(IDLE_TIMEOUT)
+	if party := getParty(guildID); party != nil && party.Until.After(deadline) {
+		deadline = party.Until
+	}
+	return deadline
+}
 
-	// If the queue is empty, delete it
-	time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
-	delete(queues, play.GuildID)
+// Whether a voice connection is still up and able to send audio
+func voiceReady(vc *discordgo.VoiceConnection) bool {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.Ready
+}
+
+// Rejoins the channel of a dropped voice connection, returning nil if that fails
+func rejoinVoice(ctx context.Context, vc *discordgo.VoiceConnection) *discordgo.VoiceConnection {
+	log.WithFields(log.Fields{
+		"guild":   vc.GuildID,
+		"channel": vc.ChannelID,
+	}).Warning("Voice connection dropped, rejoining")
+
+	guildID, channelID := vc.GuildID, vc.ChannelID
 	vc.Disconnect()
-	return nil
+
+	vc, err := joinVoice(ctx, guildID, channelID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   guildID,
+			"channel": channelID,
+			"error":   err,
+		}).Error("Failed to rejoin voice channel")
+		return nil
+	}
+	return vc
 }
 
 func onReady(s *discordgo.Session, event *discordgo.Ready) {
 	log.Info("Recieved READY payload")
-	s.UpdateStatus(0, "dank memes")
+	s.UpdateGameStatus(0, "dank memes")
 }
 
 func onGuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
@@ -1022,7 +1783,7 @@ func onGuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
 		return
 	}
 
-	if event.Guild.Unavailable != nil {
+	if event.Guild.Unavailable {
 		return
 	}
 
@@ -1096,13 +1857,21 @@ func utilSumRedisKeys(keys []string) int {
 	return total
 }
 
-func displayUserStats(cid, uid string) {
+// How many sounds a user has played, across every guild
+func userSoundCount(uid string) (int, error) {
 	keys, err := rcli.Keys(fmt.Sprintf("airhorn:*:user:%s:sound:*", uid)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return utilSumRedisKeys(keys), nil
+}
+
+func displayUserStats(cid, uid string) {
+	totalAirhorns, err := userSoundCount(uid)
 	if err != nil {
 		return
 	}
 
-	totalAirhorns := utilSumRedisKeys(keys)
 	discord.ChannelMessageSend(cid, fmt.Sprintf("Total Airhorns: %v", totalAirhorns))
 }
 
@@ -1125,64 +1894,153 @@ func utilGetMentioned(s *discordgo.Session, m *discordgo.MessageCreate) *discord
 	return nil
 }
 
-func airhornBomb(cid string, guild *discordgo.Guild, user *discordgo.User, cs string) {
+func airhornBomb(cid string, guild *discordgo.Guild, user *discordgo.User, cs string) error {
+	if user == nil {
+		discord.ChannelMessageSend(cid, "Who should I bomb? Mention them after the count.")
+		return errors.New("no one to bomb")
+	}
+
+	play := createPlay(user, guild, AIRHORN, nil)
+	if play == nil {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("%s isn't in a voice channel.", user.Username))
+		return ErrNotInVoice
+	}
+
 	count, _ := strconv.Atoi(cs)
 	discord.ChannelMessageSend(cid, ":ok_hand:"+strings.Repeat(":trumpet:", count))
 
 	// Cap it at something
 	if count > 100 {
-		return
+		return nil
 	}
 
-	play := createPlay(user, guild, AIRHORN, nil)
 	vc, err := discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, true, true)
 	if err != nil {
-		return
+		return err
 	}
 
 	for i := 0; i < count; i++ {
-		AIRHORN.Random().Play(vc)
+		if err = AIRHORN.Random().Play(playbackCtx, vc); err != nil {
+			break
+		}
 	}
 
 	vc.Disconnect()
+	return err
+}
+
+// Where a control command was sent, for picking the one shard that answers it. DMs have no
+// guild, so they're split between shards by channel instead.
+func controlHome(m *discordgo.MessageCreate, g *discordgo.Guild) string {
+	if g != nil {
+		return g.ID
+	}
+	return m.ChannelID
 }
 
 // Handles bot operator messages, should be refactored (lmao)
 func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) {
-	ourShard := shardContains(g.ID)
-
-	if scontains(parts[1], "status") && ourShard {
-		displayBotStats(m.ChannelID)
-	} else if scontains(parts[1], "stats") && ourShard {
-		if len(m.Mentions) >= 2 {
-			displayUserStats(m.ChannelID, utilGetMentioned(s, m).ID)
-		} else if len(parts) >= 3 {
-			displayUserStats(m.ChannelID, parts[2])
-		} else {
-			displayServerStats(m.ChannelID, g.ID)
+	cmd := findControlCommand(parts[1])
+	if cmd == nil || len(parts) < cmd.MinParts {
+		return
+	}
+
+	home, guildID := controlHome(m, g), ""
+	if g != nil {
+		guildID = g.ID
+	}
+
+	// Every shard sees the command, but only one of them should answer it
+	if !cmd.AllShards && !shardContains(home) {
+		return
+	}
+
+	// Commands every shard runs are still only recorded once
+	record := func(err error) {
+		if shardContains(home) {
+			audit(m.Author.ID, guildID, "control:"+cmd.Name, parts[2:], err)
 		}
-	} else if scontains(parts[1], "bomb") && len(parts) >= 4 && ourShard {
-		airhornBomb(m.ChannelID, g, utilGetMentioned(s, m), parts[3])
-	} else if scontains(parts[1], "shards") {
-		guilds := 0
-		for _, guild := range s.State.Ready.Guilds {
-			if shardContains(guild.ID) {
-				guilds += 1
-			}
+	}
+
+	if level := operatorLevel(m.Author.ID); level < cmd.Level {
+		err := fmt.Errorf("That needs the %s operator level, you have %s.", cmd.Level, level)
+		record(err)
+		if shardContains(home) {
+			reject(m.Message, err)
+		}
+		return
+	}
+
+	if g == nil && !cmd.DirectMessages {
+		if shardContains(home) {
+			reject(m.Message, fmt.Errorf("`%s` only works on a server, mention me there instead.", cmd.Name))
 		}
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
-			"Shard %v contains %v servers",
-			strings.Join(SHARDS, ","),
-			guilds))
-	} else if scontains(parts[1], "aps") && ourShard {
-		s.ChannelMessageSend(m.ChannelID, ":ok_hand: give me a sec m8")
-		go calculateAirhornsPerSecond(m.ChannelID)
+		return
+	}
+	record(cmd.Run(s, m, parts, g))
+}
+
+// Handles a message sent to the bot in a DM. Operators can run control commands without
+// mentioning the bot, and everyone can use the commands that make sense outside a server.
+func handleDirectMessage(s *discordgo.Session, m *discordgo.MessageCreate, isCommand bool) {
+	if m.Author.ID == s.State.Ready.User.ID {
+		return
+	}
+
+	msg := strings.Replace(m.ContentWithMentionsReplaced(), s.State.Ready.User.Username, "username", 1)
+	parts := strings.Split(strings.ToLower(msg), " ")
+
+	if !isCommand && operatorLevel(m.Author.ID) > OPERATOR_NONE {
+		// The mention is optional, but control commands expect one before the command
+		if parts[0] != "@username" {
+			parts = append([]string{"@username"}, parts...)
+		}
+
+		if len(parts) > 1 {
+			handleBotControlMessages(s, m, parts, nil)
+		}
+		return
+	}
+
+	// Every shard gets the DM, but only one of them should answer it
+	if !isCommand || !shardContains(m.ChannelID) {
+		return
+	}
+
+	if findCollection(parts[0]) != nil {
+		reject(m.Message, errors.New("I can only play sounds on a server, try it there."))
+		return
+	}
+
+	if cmd := findCommand(parts[0]); cmd != nil {
+		dispatchCommand(cmd, newCommandContext(s, m, nil))
 	}
-	return
 }
 
 func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if len(m.Content) <= 0 || (m.Content[0] != '!' && len(m.Mentions) < 1) {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return
+	}
+
+	if len(m.Content) <= 0 {
+		return
+	}
+
+	// Commands can use the guild's own prefix and aliases, which we turn into the usual `!command`
+	m, isCommand := applyGuildPrefix(m)
+
+	// Trivia answers and chat triggers get the first look at anything that isn't a command
+	if !isCommand && !checkTriviaAnswer(m) {
+		checkTriggers(s, m)
+	}
+
+	// DMs have no guild, so they're handled on their own
+	if m.GuildID == "" {
+		handleDirectMessage(s, m, isCommand)
+		return
+	}
+
+	if !isCommand && len(m.Mentions) < 1 {
 		return
 	}
 
@@ -1208,8 +2066,8 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	// If this is a mention, it should come from the owner (otherwise we don't care)
-	if len(m.Mentions) > 0 && m.Author.ID == OWNER && len(parts) > 0 {
+	// If this is a mention of the bot, it should come from an operator (otherwise we don't care)
+	if len(m.Mentions) > 0 && operatorLevel(m.Author.ID) > OPERATOR_NONE && len(parts) > 1 {
 		mentioned := false
 		for _, mention := range m.Mentions {
 			mentioned = (mention.ID == s.State.Ready.User.ID)
@@ -1220,7 +2078,11 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 		if mentioned {
 			handleBotControlMessages(s, m, parts, guild)
+			return
 		}
+	}
+
+	if !isCommand {
 		return
 	}
 
@@ -1230,103 +2092,153 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	}
 
 	// Find the collection for the command we got
-	for _, coll := range COLLECTIONS {
+	settings := getGuildSettings(guild.ID)
+	for _, coll := range allowedCollections(settings) {
 		if scontains(parts[0], coll.Commands...) {
 
-			// If they passed a specific sound effect, find and select that (otherwise play nothing)
-			var sound *Sound
-			if len(parts) > 1 {
-				for _, s := range coll.Sounds {
-					if parts[1] == s.Name {
-						sound = s
-					}
-				}
+			// If they named a voice channel (or someone in one), play there instead
+			target, args, err := findTargetChannel(s.State, m, guild, strings.Fields(m.Content)[1:])
+			if err != nil {
+				reject(m.Message, renderPrefixError(settings, err))
+				return
+			}
 
-				if sound == nil {
-					return
-				}
+			// Work out which sounds they asked for (a random one if they didn't say), how many
+			// times, and which parts of them
+			requests, err := parseSoundRequests(coll, args)
+			if err != nil {
+				reject(m.Message, renderPrefixError(settings, err))
+				return
 			}
 
-			go enqueuePlay(m.Author, guild, coll, sound)
+			play, err := preparePlay(s.State, m.Author, guild, target, coll, requests[0].Sound)
+			if err != nil {
+				reject(m.Message, renderPrefixError(settings, err))
+				return
+			}
+			play.Message = m.Message
+			play.Start, play.End = play.Sound.frames(requests[0].Start, requests[0].End)
+
+			// The rest are chained onto the first, so they queue (and play) as one
+			for _, request := range requests[1:] {
+				next := play.Append(coll, request.Sound)
+				next.Start, next.End = next.Sound.frames(request.Start, request.End)
+			}
+
+			queued, err := enqueuePlay(play)
+			respond(m.Message, queued, renderPrefixError(settings, err))
 			return
 		}
 	}
 	
 	
 	// Check if message was a bot command instead of a sound
-	for _, coll := range BOTCOMMANDS {
-		if scontains(parts[0], coll.Commands...) {
+	if cmd := findCommand(parts[0]); cmd != nil && strings.HasPrefix(parts[0], "!") {
+		dispatchCommand(cmd, newCommandContext(s, m, guild))
+	}
+}
 
-			if parts[0] == "!help" {
-				
-			
-			
-				// If message passed a level 2 command, find and select that
-				if len(parts) > 1 {
-				
-					cmdfound := false
-				
-					for _, coll2 := range COLLECTIONS {
-						if scontains("!" + parts[1], coll2.Commands...) {
-						
-							helplist := "\n"
-							cmdfound = true
-						
-							for _, j := range coll2.Sounds {
-								helplist = helplist + j.Name + "\n"
-							}
-							s.ChannelMessageSend(m.ChannelID, "!" + parts[1] + " <sound>\n" + helplist)
-						}
-					}
-					
-					if !cmdfound {
-						s.ChannelMessageSend(m.ChannelID, "Bro, that's not a thing. ¯\\_(ツ)_/¯")
-					} 
-				
-					
-				} else {
-				
-					// give level 1 help
-					
-					helplist := "I can play sounds from these categories.\n"
-					
-					for _, j := range COLLECTIONS {
-					
-						helplist = helplist + "\n"
-					
-						for _, j2 := range j.Commands {
-							helplist = helplist + j2 + ", "
-						}
-					
-					}
-					
-					helplist = helplist + "\n\nTry !help <category> for specific sounds."
-					helplist = helplist + "\nIf you'd like to contribute to Droppy, please use the to-do spreadsheet: https://docs.google.com/spreadsheets/d/1hKDArZS85DQ2cQ3tVGHk_YIYHpsKXM6XHxdsas14-6s/edit#gid=0"
-					s.ChannelMessageSend(m.ChannelID, helplist)
-									
-				}
-				
-			} else if parts[0] == "!colorme" {
-			
-				s.ChannelMessageSend(m.ChannelID, "Coming soon :)")
-			}
+// Shuts the bot down cleanly: stops accepting commands, gives queued sounds until
+// SHUTDOWN_TIMEOUT to finish, then leaves voice, flushes stats and closes the session
+func shutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+	close(shutdownStarted)
+	log.Info("Shutting down, waiting for queues to drain...")
+
+	deadline := time.After(SHUTDOWN_TIMEOUT)
+drain:
+	for {
+		queuesMutex.Lock()
+		remaining := len(queues)
+		queuesMutex.Unlock()
+
+		if remaining == 0 {
+			break
+		}
+
+		select {
+		case <-deadline:
+			log.WithFields(log.Fields{
+				"guilds": remaining,
+			}).Warning("Shutdown deadline passed, stopping playback")
+			break drain
+		case <-time.After(time.Millisecond * 250):
 		}
 	}
-	
+	stopPlayback()
+
+	// Disconnect anything left over, including connections we never tracked in a queue
+	discord.RLock()
+	connections := make([]*discordgo.VoiceConnection, 0, len(discord.VoiceConnections))
+	for _, vc := range discord.VoiceConnections {
+		connections = append(connections, vc)
+	}
+	discord.RUnlock()
+
+	for _, vc := range connections {
+		vc.Disconnect()
+	}
+
+	// Playback that's still unwinding can track stats, so it has to finish before we wait on them
+	playbackRoutines.Wait()
+
+	log.Info("Flushing stats...")
+	pendingStats.Wait()
+	if rcli != nil {
+		rcli.Close()
+	}
+
+	if err := discord.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to close discord session")
+	}
+	log.Info("Dropbot has left the building.")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "register" {
+		registerSlashCommands(os.Args[2:])
+		return
+	}
+
 	var (
 		Token = flag.String("t", "", "Discord Authentication Token")
 		Redis = flag.String("r", "", "Redis Connection String")
 		Shard = flag.String("s", "", "Integers to shard by")
 		Owner = flag.String("o", "", "Owner ID")
+		Ops   = flag.String("operators", "", "File of operators, one `<user id> <viewer|admin>` per line")
+		Audit = flag.String("audit", "", "File to append the audit log to, as well as redis")
+		Idle  = flag.Duration("i", 0, "How long to stay in voice after the queue empties (eg 5m)")
+		Meta  = flag.String("metadata", "", "JSON file of sound descriptions, sources, transcripts and credits")
+		React = flag.String("reactions", "", "Comma separated reactions for accepted, queued and rejected commands")
+		TTL   = flag.Duration("explain", FEEDBACK_REPLY_TTL, "How long rejection explanations stay up (0 disables them)")
 		err   error
 	)
 	flag.Parse()
 
+	if *Ops != "" {
+		if err := loadOperators(*Ops); err != nil {
+			log.WithFields(log.Fields{
+				"file":  *Ops,
+				"error": err,
+			}).Fatal("Failed to load operators")
+			return
+		}
+	}
+
 	if *Owner != "" {
-		OWNER = *Owner
+		OPERATORS[*Owner] = OPERATOR_ADMIN
+	}
+
+	AUDIT_FILE = *Audit
+
+	IDLE_TIMEOUT = *Idle
+
+	FEEDBACK_REPLY_TTL = *TTL
+	if *React != "" {
+		reactions := append(strings.Split(*React, ","), "", "", "")
+		FEEDBACK_ACCEPTED, FEEDBACK_QUEUED, FEEDBACK_REJECTED = reactions[0], reactions[1], reactions[2]
 	}
 
 	// Make sure shard is either empty, or an integer
@@ -1350,6 +2262,16 @@ func main() {
 		coll.Load()
 	}
 
+	if *Meta != "" {
+		if err := loadSoundMetadata(*Meta); err != nil {
+			log.WithFields(log.Fields{
+				"file":  *Meta,
+				"error": err,
+			}).Fatal("Failed to load sound metadata")
+			return
+		}
+	}
+
 	// If we got passed a redis server, try to connect
 	if *Redis != "" {
 		log.Info("Connecting to redis...")
@@ -1364,6 +2286,8 @@ func main() {
 		}
 	}
 
+	loadCollectionStates()
+
 	// Create a discord session
 	log.Info("Starting discord session...")
 	discord, err = discordgo.New(*Token)
@@ -1377,6 +2301,10 @@ func main() {
 	discord.AddHandler(onReady)
 	discord.AddHandler(onGuildCreate)
 	discord.AddHandler(onMessageCreate)
+	discord.AddHandler(onVoiceStateUpdate)
+	discord.AddHandler(onMessageReactionAdd)
+	discord.AddHandler(onMessageReactionRemove)
+	discord.AddHandler(onInteractionCreate)
 
 	err = discord.Open()
 	if err != nil {
@@ -1386,11 +2314,27 @@ func main() {
 		return
 	}
 
+	go runScheduler()
+
 	// We're running!
 	log.Info("Dropbot is ready to drop some dank memes.")
 
 	// Wait for a signal to quit
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+
+	log.WithFields(log.Fields{
+		"signal": sig,
+	}).Info("Received signal")
+
+	// A second signal skips whatever the shutdown is still waiting on
+	go func() {
+		sig := <-c
+		log.WithFields(log.Fields{
+			"signal": sig,
+		}).Warning("Received second signal, exiting without finishing shutdown")
+		os.Exit(1)
+	}()
+	shutdown()
 }
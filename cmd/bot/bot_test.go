@@ -0,0 +1,15 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSoundRequestsRangeNeedsSound(t *testing.T) {
+	for _, args := range [][]string{{"0:05-0:12"}, {"x2", "0:05-0:12"}} {
+		_, err := parseSoundRequests(AIRHORN, args)
+		if err == nil || !strings.HasPrefix(err.Error(), "Pick a sound to play part of") {
+			t.Fatalf("%v should ask for a sound to play part of, got %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrCategoriesUsage = errors.New("Try `!categories`, `!categories nsfw on|off`, `!categories disable <category...>`, `!categories enable <category...>` or `!categories only <category...>` (`!categories only all` to allow everything again).")
+
+// Whether a guild's settings let it see and play a collection. Hidden collections are left
+// out of help, search and random picks as if they didn't exist.
+func collectionAllowed(settings *GuildSettings, coll *SoundCollection) bool {
+	if coll.NSFW && settings.NSFWDisabled {
+		return false
+	}
+
+	if scontains(coll.Prefix, settings.DisabledCollections...) {
+		return false
+	}
+	return len(settings.AllowedCollections) == 0 || scontains(coll.Prefix, settings.AllowedCollections...)
+}
+
+// Like findCollection, but only finds collections the guild allows
+func findGuildCollection(settings *GuildSettings, name string) *SoundCollection {
+	coll := findCollection(name)
+	if coll == nil || !collectionAllowed(settings, coll) {
+		return nil
+	}
+	return coll
+}
+
+// Collections a guild allows, whether or not they're switched on
+func allowedCollections(settings *GuildSettings) []*SoundCollection {
+	colls := make([]*SoundCollection, 0, len(COLLECTIONS))
+	for _, coll := range COLLECTIONS {
+		if collectionAllowed(settings, coll) {
+			colls = append(colls, coll)
+		}
+	}
+	return colls
+}
+
+// Collections that are switched on and allowed in a guild, for picking random sounds from
+func guildCollections(settings *GuildSettings) []*SoundCollection {
+	colls := make([]*SoundCollection, 0, len(COLLECTIONS))
+	for _, coll := range enabledCollections() {
+		if collectionAllowed(settings, coll) {
+			colls = append(colls, coll)
+		}
+	}
+	return colls
+}
+
+// Resolves category names to their prefixes, rejecting any that don't exist
+func parseCategoryNames(names []string) ([]string, error) {
+	prefixes := make([]string, 0, len(names))
+	for _, name := range names {
+		coll := findCollection(name)
+		if coll == nil {
+			return nil, fmt.Errorf("I don't have a category called **%s**, try `!help`.", name)
+		}
+		prefixes = append(prefixes, coll.Prefix)
+	}
+	return prefixes, nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:  "categories",
+		Args:  "[nsfw|disable|enable|only ...]",
+		Help:  "Shows or sets which categories are hidden on this server",
+		Usage: ErrCategoriesUsage.Error(),
+		Run:   handleCategoriesCommand,
+	})
+}
+
+// Handles `!categories` (which shows what the guild filters out) and the admin only
+// `!categories nsfw|disable|enable|only` commands
+func handleCategoriesCommand(c *CommandContext) error {
+	args := c.Args
+	if len(args) == 0 {
+		c.Reply(describeCategories(c.settings()))
+		return nil
+	}
+
+	if !c.isGuildAdmin() {
+		c.audit(ErrNotGuildAdmin)
+		return ErrNotGuildAdmin
+	}
+
+	var (
+		change   func(*GuildSettings)
+		prefixes []string
+		err      error
+	)
+
+	switch {
+	case args[0] == "nsfw" && len(args) == 2 && (args[1] == "on" || args[1] == "off"):
+		disabled := args[1] == "off"
+		change = func(gs *GuildSettings) { gs.NSFWDisabled = disabled }
+	case args[0] == "only" && len(args) == 2 && args[1] == "all":
+		change = func(gs *GuildSettings) { gs.AllowedCollections = nil }
+	case scontains(args[0], "disable", "enable", "only") && len(args) > 1:
+		if prefixes, err = parseCategoryNames(args[1:]); err != nil {
+			break
+		}
+
+		change = func(gs *GuildSettings) {
+			switch args[0] {
+			case "only":
+				gs.AllowedCollections = prefixes
+			case "disable":
+				for _, prefix := range prefixes {
+					if !scontains(prefix, gs.DisabledCollections...) {
+						gs.DisabledCollections = append(gs.DisabledCollections, prefix)
+					}
+				}
+			case "enable":
+				kept := make([]string, 0, len(gs.DisabledCollections))
+				for _, prefix := range gs.DisabledCollections {
+					if !scontains(prefix, prefixes...) {
+						kept = append(kept, prefix)
+					}
+				}
+				gs.DisabledCollections = kept
+			}
+		}
+	default:
+		err = ErrCategoriesUsage
+	}
+
+	if err == nil {
+		err = c.Settings.Update(c.Guild.ID, change)
+	}
+	c.audit(err)
+
+	if err != nil {
+		return err
+	}
+	c.Reply(":ok_hand: " + describeCategories(c.settings()))
+	return nil
+}
+
+// Describes which categories a guild filters out
+func describeCategories(settings *GuildSettings) string {
+	lines := make([]string, 0)
+	if settings.NSFWDisabled {
+		nsfw := make([]string, 0)
+		for _, coll := range COLLECTIONS {
+			if coll.NSFW {
+				nsfw = append(nsfw, coll.Prefix)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("NSFW categories are hidden (%s).", strings.Join(nsfw, ", ")))
+	}
+
+	if len(settings.AllowedCollections) > 0 {
+		lines = append(lines, fmt.Sprintf("Only these categories are allowed: %s.", strings.Join(settings.AllowedCollections, ", ")))
+	}
+
+	if len(settings.DisabledCollections) > 0 {
+		lines = append(lines, fmt.Sprintf("These categories are disabled: %s.", strings.Join(settings.DisabledCollections, ", ")))
+	}
+
+	if len(lines) == 0 {
+		return "Every category is allowed on this server."
+	}
+	return strings.Join(lines, "\n")
+}
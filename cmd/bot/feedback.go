@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Reactions added to sound commands, an empty string skips that reaction
+	FEEDBACK_ACCEPTED = "👌"
+	FEEDBACK_QUEUED   = "⏳"
+	FEEDBACK_REJECTED = "❌"
+
+	// How long the explanation for a rejected command stays up (0 disables explanations)
+	FEEDBACK_REPLY_TTL = time.Second * 5
+)
+
+// Reports the outcome of a command back to whoever sent it
+func respond(m *discordgo.Message, queued bool, err error) {
+	if err != nil {
+		reject(m, err)
+	} else if queued {
+		react(m, FEEDBACK_QUEUED)
+	} else {
+		react(m, FEEDBACK_ACCEPTED)
+	}
+}
+
+// Marks a command as rejected, and replies with a short lived explanation of why
+func reject(m *discordgo.Message, reason error) {
+	if m == nil {
+		return
+	}
+
+	react(m, FEEDBACK_REJECTED)
+	explain(m.ChannelID, m.Author.ID, reason)
+}
+
+// Tells a user why something didn't work with a short lived reply
+func explain(channelID, userID string, reason error) {
+	if FEEDBACK_REPLY_TTL <= 0 || reason == nil {
+		return
+	}
+
+	reply, err := discord.ChannelMessageSend(channelID, fmt.Sprintf("<@%s> %s", userID, reason))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"channel": channelID,
+			"error":   err,
+		}).Warning("Failed to send feedback reply")
+		return
+	}
+
+	time.AfterFunc(FEEDBACK_REPLY_TTL, func() {
+		discord.ChannelMessageDelete(reply.ChannelID, reply.ID)
+	})
+}
+
+func react(m *discordgo.Message, emoji string) {
+	if m == nil || emoji == "" {
+		return
+	}
+
+	if err := discord.MessageReactionAdd(m.ChannelID, m.ID, emoji); err != nil {
+		log.WithFields(log.Fields{
+			"channel": m.ChannelID,
+			"message": m.ID,
+			"error":   err,
+		}).Warning("Failed to add feedback reaction")
+	}
+}
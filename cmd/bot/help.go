@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CONTRIBUTE_URL = "https://docs.google.com/spreadsheets/d/1hKDArZS85DQ2cQ3tVGHk_YIYHpsKXM6XHxdsas14-6s/edit#gid=0"
+
+	// Lines on each page of help, well under the embed limits even with long descriptions
+	HELP_PAGE_SIZE = 15
+)
+
+// HelpMessage is a help embed the arrow reactions flip between the pages of
+type HelpMessage struct {
+	ChannelID string
+	MessageID string
+	Pages     []*discordgo.MessageEmbed
+	Created   time.Time
+
+	page      int
+	responder Responder
+	sync.Mutex
+}
+
+var (
+	ErrHelpDM = errors.New("I couldn't DM you, check your privacy settings allow DMs from server members.")
+
+	// Help messages with more than one page, keyed by message id
+	helpMessages      = make(map[string]*HelpMessage)
+	helpMessagesMutex sync.Mutex
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:  "help",
+		Args:  "[dm] [category|command]",
+		Help:  "Lists what I can do, or the sounds in a category",
+		Usage: "Add `dm` to get it in a DM instead, like `!help dm airhorn`.",
+		Run:   handleHelpCommand,
+
+		DirectMessages: true,
+	})
+
+	registerCommand(&Command{
+		Name: "colorme",
+		Help: "Coming soon",
+		Run: func(c *CommandContext) error {
+			c.Reply("Coming soon :)")
+			return nil
+		},
+	})
+}
+
+// Handles `!help [dm]`, `!help [dm] <category>` and `!help [dm] <command>`
+func handleHelpCommand(c *CommandContext) error {
+	args := c.Args
+	dm := len(args) > 0 && args[0] == "dm"
+	if dm {
+		args = args[1:]
+	}
+
+	var (
+		pages []*discordgo.MessageEmbed
+		text  string
+	)
+
+	if len(args) == 0 {
+		pages = generalHelp(c.guildID(), c.settings())
+	} else if coll := findGuildCollection(c.settings(), args[0]); coll != nil {
+		pages = collectionHelp(coll)
+	} else if cmd := findCommand(args[0]); cmd != nil {
+		text = commandHelp(cmd)
+	} else {
+		return errors.New("Bro, that's not a thing. ¯\\_(ツ)_/¯")
+	}
+
+	r := c.Responder
+	if dm && c.Guild != nil {
+		var err error
+		if r, err = c.DirectMessage(c.Author.ID); err != nil {
+			return ErrHelpDM
+		}
+	}
+
+	var err error
+	if pages == nil {
+		_, err = r.Reply(text)
+	} else {
+		err = sendHelpPages(r, pages)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"channel": c.ChannelID,
+			"error":   err,
+		}).Warning("Failed to send help")
+
+		if dm {
+			return ErrHelpDM
+		}
+		return nil
+	}
+
+	if dm && c.Guild != nil {
+		c.React(c.ID, "📬")
+	}
+	return nil
+}
+
+// Sends the first page of help, adding the arrow reactions if there are more
+func sendHelpPages(r Responder, pages []*discordgo.MessageEmbed) error {
+	msg, err := r.ReplyEmbed(pages[0])
+	if err != nil || len(pages) < 2 {
+		return err
+	}
+
+	help := &HelpMessage{
+		ChannelID: msg.ChannelID,
+		MessageID: msg.ID,
+		Pages:     pages,
+		Created:   time.Now(),
+		responder: r,
+	}
+
+	helpMessagesMutex.Lock()
+	for id, old := range helpMessages {
+		if time.Since(old.Created) > BOARD_LIFETIME {
+			delete(helpMessages, id)
+		}
+	}
+	helpMessages[msg.ID] = help
+	helpMessagesMutex.Unlock()
+
+	r.React(msg.ID, BOARD_PREV, BOARD_NEXT)
+	return nil
+}
+
+func findHelpMessage(messageID string) *HelpMessage {
+	helpMessagesMutex.Lock()
+	defer helpMessagesMutex.Unlock()
+
+	help := helpMessages[messageID]
+	if help == nil || time.Since(help.Created) > BOARD_LIFETIME {
+		return nil
+	}
+	return help
+}
+
+// Turns the page if the emoji is one of the arrows
+func (h *HelpMessage) React(emoji string) {
+	switch {
+	case sameEmoji(emoji, BOARD_PREV):
+		h.Turn(-1)
+	case sameEmoji(emoji, BOARD_NEXT):
+		h.Turn(1)
+	}
+}
+
+// Moves by a number of pages (wrapping around) and redraws the message
+func (h *HelpMessage) Turn(by int) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.page = (h.page + by + len(h.Pages)) % len(h.Pages)
+	if _, err := h.responder.EditEmbed(h.MessageID, h.Pages[h.page]); err != nil {
+		log.WithFields(log.Fields{
+			"channel": h.ChannelID,
+			"message": h.MessageID,
+			"error":   err,
+		}).Warning("Failed to update help")
+	}
+}
+
+// Bots can't take other people's reactions off in DMs, so there taking an arrow off turns the
+// page as well
+func onMessageReactionRemove(s *discordgo.Session, r *discordgo.MessageReactionRemove) {
+	if r.GuildID != "" || r.UserID == s.State.Ready.User.ID {
+		return
+	}
+
+	if help := findHelpMessage(r.MessageID); help != nil {
+		help.React(r.Emoji.Name)
+	}
+}
+
+// Pages listing the categories a guild with these settings can play and every command. In DMs
+// ("" for the guild) it lists every category but only the commands that work there.
+func generalHelp(guildID string, settings *GuildSettings) []*discordgo.MessageEmbed {
+	categories := make([]string, 0)
+	if prefix := guildPrefix(settings); prefix != DEFAULT_PREFIX {
+		categories = append(categories, fmt.Sprintf("Commands start with `%s` on this server.", prefix), "")
+	}
+
+	for _, coll := range allowedCollections(settings) {
+		line := fmt.Sprintf("%s · %d sounds", strings.Join(coll.Commands, ", "), len(coll.Sounds))
+		if !coll.Enabled() {
+			line += " (off)"
+		}
+		categories = append(categories, line)
+	}
+
+	commands := make([]string, 0)
+	for _, cmd := range listCommands() {
+		if guildID == "" && !cmd.DirectMessages {
+			continue
+		}
+		commands = append(commands, fmt.Sprintf("`%s` %s", cmd.Synopsis(), cmd.Help))
+	}
+	commands = append(commands, "", fmt.Sprintf("If you'd like to contribute to Droppy, please use the [to-do spreadsheet](%s).", CONTRIBUTE_URL))
+
+	categoriesTitle, commandsTitle := "Categories", "Commands"
+	if guildID == "" {
+		categoriesTitle, commandsTitle = "Categories I can play on a server", "Commands that work in DMs"
+	}
+
+	pages := append(helpPages(categoriesTitle, categories), helpPages(commandsTitle, commands)...)
+	return numberHelpPages(pages, "!help <category> lists its sounds, !help <command> explains a command")
+}
+
+// Pages listing the sounds in a category, with how long they are and what we know about them
+func collectionHelp(coll *SoundCollection) []*discordgo.MessageEmbed {
+	title := coll.Commands[0] + " sounds"
+	if !coll.Enabled() {
+		title += " (switched off right now)"
+	}
+
+	lines := make([]string, 0, len(coll.Sounds))
+	for _, sound := range coll.Sounds {
+		line := fmt.Sprintf("`%s` %s", sound.Name, formatTimestamp(sound.Duration()))
+		if summary := sound.Summary(coll); summary != "" {
+			line += " · " + summary
+		}
+		lines = append(lines, line)
+	}
+	pages := helpPages(title, lines)
+	if coll.Source != "" {
+		for _, page := range pages {
+			page.Description = "From " + coll.Source + "\n\n" + page.Description
+		}
+	}
+	return numberHelpPages(pages, fmt.Sprintf("Play one with %s <sound>", coll.Commands[0]))
+}
+
+// Splits lines over embeds of HELP_PAGE_SIZE lines each, with at least one page even if
+// there are no lines
+func helpPages(title string, lines []string) []*discordgo.MessageEmbed {
+	pages := make([]*discordgo.MessageEmbed, 0)
+	for start := 0; start == 0 || start < len(lines); start += HELP_PAGE_SIZE {
+		end := start + HELP_PAGE_SIZE
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		pages = append(pages, &discordgo.MessageEmbed{
+			Title:       title,
+			Description: strings.Join(lines[start:end], "\n"),
+		})
+	}
+	return pages
+}
+
+// Puts the page numbers and a tip in the footer of each page
+func numberHelpPages(pages []*discordgo.MessageEmbed, tip string) []*discordgo.MessageEmbed {
+	for i, page := range pages {
+		text := tip
+		if len(pages) > 1 {
+			text = fmt.Sprintf("Page %d/%d · %s", i+1, len(pages), tip)
+		}
+		page.Footer = &discordgo.MessageEmbedFooter{Text: text}
+	}
+	return pages
+}
+
+// Describes how to use a command
+func commandHelp(cmd *Command) string {
+	lines := []string{"`" + cmd.Synopsis() + "` " + cmd.Help + "."}
+	if len(cmd.Aliases) > 0 {
+		lines = append(lines, "Also works as !"+strings.Join(cmd.Aliases, ", !")+".")
+	}
+
+	if cmd.Usage != "" {
+		lines = append(lines, cmd.Usage)
+	}
+
+	if cmd.Permission == PERMISSION_GUILD_ADMIN {
+		lines = append(lines, "Only server admins can use it.")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// How long someone has to wait between intros, so channel hopping can't spam them
+	INTRO_COOLDOWN = time.Minute * 5
+
+	// When each user last got an intro, keyed by guild and user id
+	introCooldowns      = make(map[string]time.Time)
+	introCooldownsMutex sync.Mutex
+
+	ErrNotGuildAdmin = errors.New("Only server admins can do that.")
+)
+
+func init() {
+	registerCommand(&Command{
+		Name: "intro",
+		Args: "[set <category> [sound]|clear|on|off]",
+		Help: "Picks a sound to play when you join a voice channel",
+		Run:  handleIntroCommand,
+	})
+}
+
+// Handles `!intro`, `!intro set <category> [sound]`, `!intro clear` and (for admins)
+// `!intro on|off`
+func handleIntroCommand(c *CommandContext) error {
+	args := c.Args
+	settings := c.settings()
+
+	if len(args) == 0 {
+		switch ref := settings.Intros[c.Author.ID]; {
+		case settings.IntrosDisabled:
+			c.Reply("Intros are turned off on this server.")
+		case ref == nil:
+			c.Reply("You don't have an intro, set one with `!intro set <category> [sound]`.")
+		default:
+			c.Reply(fmt.Sprintf("Your intro is `%s`.", ref))
+		}
+		return nil
+	}
+
+	var (
+		reply string
+		err   error
+	)
+
+	switch args[0] {
+	case "set":
+		var ref *SoundRef
+		ref, err = parseSoundRef(args[1:])
+		if err != nil {
+			break
+		}
+
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			if gs.Intros == nil {
+				gs.Intros = make(map[string]*SoundRef)
+			}
+			gs.Intros[c.Author.ID] = ref
+		})
+		reply = fmt.Sprintf(":ok_hand: Your intro is now `%s`.", ref)
+	case "clear":
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			delete(gs.Intros, c.Author.ID)
+		})
+		reply = ":ok_hand: Your intro is gone."
+	case "on", "off":
+		if !c.isGuildAdmin() {
+			err = ErrNotGuildAdmin
+			break
+		}
+
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			gs.IntrosDisabled = args[0] == "off"
+		})
+		reply = fmt.Sprintf(":ok_hand: Intros are now %s.", args[0])
+	default:
+		err = errors.New("Try `!intro set <category> [sound]`, `!intro clear` or `!intro on|off`.")
+	}
+
+	if args[0] == "on" || args[0] == "off" {
+		c.audit(err)
+	}
+
+	if err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Plays a users intro when they join a voice channel
+func onVoiceStateUpdate(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+	if atomic.LoadInt32(&shuttingDown) == 1 || v.UserID == s.State.Ready.User.ID || !shardContains(v.GuildID) {
+		return
+	}
+
+	// Only care about joining (or moving to) a channel, not mutes, deafens or leaving
+	if v.ChannelID == "" || (v.BeforeUpdate != nil && v.BeforeUpdate.ChannelID == v.ChannelID) {
+		return
+	}
+
+	settings := getGuildSettings(v.GuildID)
+	ref := settings.Intros[v.UserID]
+	if settings.IntrosDisabled || ref == nil {
+		return
+	}
+
+	coll, sound := ref.Resolve()
+	if coll == nil {
+		return
+	}
+
+	guild, _ := s.State.Guild(v.GuildID)
+	channel, _ := s.State.Channel(v.ChannelID)
+	member, _ := s.State.Member(v.GuildID, v.UserID)
+	if guild == nil || channel == nil || member == nil || member.User == nil || member.User.Bot {
+		return
+	}
+
+	if !introCooldownExpired(v.GuildID, v.UserID) {
+		return
+	}
+
+	play, err := preparePlay(s.State, member.User, guild, channel, coll, sound)
+	if err == nil {
+		play.tag("intro")
+		_, err = enqueuePlay(play)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   v.GuildID,
+			"channel": v.ChannelID,
+			"user":    v.UserID,
+			"error":   err,
+		}).Warning("Failed to play intro")
+	}
+}
+
+// Checks (and restarts) a users intro cooldown
+func introCooldownExpired(guildID, userID string) bool {
+	key := guildID + ":" + userID
+
+	introCooldownsMutex.Lock()
+	defer introCooldownsMutex.Unlock()
+
+	if last, ok := introCooldowns[key]; ok && time.Since(last) < INTRO_COOLDOWN {
+		return false
+	}
+	introCooldowns[key] = time.Now()
+	return true
+}
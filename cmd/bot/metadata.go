@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Longest bit of a transcript help and search show, the rest is cut off
+const MAX_TRANSCRIPT_PREVIEW = 60
+
+// SoundMetadata is an entry in the metadata file, adding details to a sound in the catalog.
+// Fields left out keep whatever the catalog says.
+type SoundMetadata struct {
+	Collection  string `json:"collection"`
+	Sound       string `json:"sound"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Transcript  string `json:"transcript,omitempty"`
+	AddedBy     string `json:"added_by,omitempty"`
+
+	// Date it was added, like 2016-05-21
+	Added string `json:"added,omitempty"`
+}
+
+// Loads a JSON list of SoundMetadata onto the sounds it describes. Entries for sounds we don't
+// have are skipped with a warning, so the file can be shared between versions of the catalog.
+func loadSoundMetadata(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entries []*SoundMetadata
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		var sound *Sound
+		if coll := findCollection(entry.Collection); coll != nil {
+			sound = coll.Find(entry.Sound)
+		}
+
+		if sound == nil {
+			log.WithFields(log.Fields{
+				"collection": entry.Collection,
+				"sound":      entry.Sound,
+			}).Warning("Skipping metadata for a sound we don't have")
+			continue
+		}
+
+		if entry.Added != "" {
+			added, err := time.Parse("2006-01-02", entry.Added)
+			if err != nil {
+				return fmt.Errorf("entry %d: added should look like 2016-05-21", i+1)
+			}
+			sound.Added = added
+		}
+
+		if entry.Description != "" {
+			sound.Description = entry.Description
+		}
+
+		if entry.Source != "" {
+			sound.Source = entry.Source
+		}
+
+		if entry.Transcript != "" {
+			sound.Transcript = entry.Transcript
+		}
+
+		if entry.AddedBy != "" {
+			sound.AddedBy = entry.AddedBy
+		}
+	}
+	return nil
+}
+
+// One line of whatever we know about a sound in a collection, eg
+// `Lots of quick airhorns · “what's said” · added by someone on 21 May 2016`
+func (s *Sound) Summary(coll *SoundCollection) string {
+	parts := make([]string, 0)
+	if s.Description != "" {
+		parts = append(parts, s.Description)
+	}
+
+	if s.Transcript != "" {
+		transcript := []rune(s.Transcript)
+		if len(transcript) > MAX_TRANSCRIPT_PREVIEW {
+			transcript = append(transcript[:MAX_TRANSCRIPT_PREVIEW], '…')
+		}
+		parts = append(parts, "“"+string(transcript)+"”")
+	}
+
+	if s.Source != "" && s.Source != coll.Source {
+		parts = append(parts, "from "+s.Source)
+	}
+
+	switch {
+	case s.AddedBy != "" && !s.Added.IsZero():
+		parts = append(parts, fmt.Sprintf("added by %s on %s", s.AddedBy, s.Added.Format("2 Jan 2006")))
+	case s.AddedBy != "":
+		parts = append(parts, "added by "+s.AddedBy)
+	case !s.Added.IsZero():
+		parts = append(parts, "added on "+s.Added.Format("2 Jan 2006"))
+	}
+	return strings.Join(parts, " · ")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// OperatorLevel is how much an operator can do with the bot's control commands
+type OperatorLevel int
+
+const (
+	OPERATOR_NONE OperatorLevel = iota
+
+	// Viewers can look at status and stats
+	OPERATOR_VIEWER
+
+	// Admins can also change how the bot behaves, and count as admins in every guild
+	OPERATOR_ADMIN
+)
+
+func (l OperatorLevel) String() string {
+	switch l {
+	case OPERATOR_VIEWER:
+		return "viewer"
+	case OPERATOR_ADMIN:
+		return "admin"
+	}
+	return "none"
+}
+
+func parseOperatorLevel(name string) (OperatorLevel, error) {
+	switch strings.ToLower(name) {
+	case "viewer":
+		return OPERATOR_VIEWER, nil
+	case "admin":
+		return OPERATOR_ADMIN, nil
+	}
+	return OPERATOR_NONE, fmt.Errorf("unknown operator level %q", name)
+}
+
+// People who run the bot, keyed by user id. Loaded at startup from the -operators file, plus
+// the -o owner as an admin.
+var OPERATORS = make(map[string]OperatorLevel)
+
+// Loads operators from a file with one `<user id> <viewer|admin>` per line. Blank lines and
+// lines starting with # are skipped.
+func loadOperators(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected `<user id> <level>`", line)
+		}
+
+		level, err := parseOperatorLevel(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		OPERATORS[fields[0]] = level
+	}
+	return scanner.Err()
+}
+
+func operatorLevel(userID string) OperatorLevel {
+	return OPERATORS[userID]
+}
+
+// ControlCommand is a command operators can run by mentioning the bot, eg `@bot status`, or
+// by DMing it the command
+type ControlCommand struct {
+	Name string
+
+	// Lowest operator level that can run it
+	Level OperatorLevel
+
+	// Whether every shard should run it, instead of just the one with the guild it was sent in
+	AllShards bool
+
+	// Fewest words the message needs, counting the mention and the command
+	MinParts int
+
+	// Whether it also works in DMs, where there's no guild to pass to Run
+	DirectMessages bool
+
+	Run func(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error
+}
+
+var CONTROL_COMMANDS []*ControlCommand = []*ControlCommand{
+	{
+		Name:           "status",
+		Level:          OPERATOR_VIEWER,
+		DirectMessages: true,
+		Run: func(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+			displayBotStats(m.ChannelID)
+			return nil
+		},
+	},
+	{
+		Name:           "stats",
+		Level:          OPERATOR_VIEWER,
+		DirectMessages: true,
+		Run: func(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+			// The bot is usually mentioned too, so look for whoever else is. Mentions show up
+			// in parts as @names, so anything else there is a user id.
+			if user := utilGetMentioned(s, m); user != nil {
+				displayUserStats(m.ChannelID, user.ID)
+			} else if len(parts) >= 3 && !strings.HasPrefix(parts[2], "@") {
+				displayUserStats(m.ChannelID, parts[2])
+			} else if g != nil && len(parts) < 3 {
+				displayServerStats(m.ChannelID, g.ID)
+			} else {
+				s.ChannelMessageSend(m.ChannelID, "Whose stats? Mention someone or give their user id.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:           "shards",
+		Level:          OPERATOR_VIEWER,
+		AllShards:      true,
+		DirectMessages: true,
+		Run: func(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+			guilds := 0
+			for _, guild := range s.State.Ready.Guilds {
+				if shardContains(guild.ID) {
+					guilds += 1
+				}
+			}
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
+				"Shard %v contains %v servers",
+				strings.Join(SHARDS, ","),
+				guilds))
+			return nil
+		},
+	},
+	{
+		Name:           "aps",
+		Level:          OPERATOR_VIEWER,
+		DirectMessages: true,
+		Run: func(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+			s.ChannelMessageSend(m.ChannelID, ":ok_hand: give me a sec m8")
+			go calculateAirhornsPerSecond(m.ChannelID)
+			return nil
+		},
+	},
+	{
+		Name:     "bomb",
+		Level:    OPERATOR_ADMIN,
+		MinParts: 4,
+		Run: func(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+			return airhornBomb(m.ChannelID, g, utilGetMentioned(s, m), parts[3])
+		},
+	},
+	{
+		Name:           "audit",
+		Level:          OPERATOR_ADMIN,
+		DirectMessages: true,
+		Run:            runAuditQuery,
+	},
+	{
+		Name:           "enable",
+		Level:          OPERATOR_ADMIN,
+		AllShards:      true,
+		MinParts:       3,
+		DirectMessages: true,
+		Run:            runCollectionToggle,
+	},
+	{
+		Name:           "disable",
+		Level:          OPERATOR_ADMIN,
+		AllShards:      true,
+		MinParts:       3,
+		DirectMessages: true,
+		Run:            runCollectionToggle,
+	},
+}
+
+// Handles `@bot enable <collection>` and `@bot disable <collection>`. Every shard switches the
+// collection, but only the one the command was sent to replies.
+func runCollectionToggle(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) error {
+	reply := func(text string) {
+		if shardContains(controlHome(m, g)) {
+			s.ChannelMessageSend(m.ChannelID, text)
+		}
+	}
+
+	coll := findCollection(parts[2])
+	if coll == nil {
+		reply(fmt.Sprintf("No category called %s", parts[2]))
+		return errors.New("no such category")
+	}
+
+	if err := setCollectionEnabled(coll, parts[1] == "enable"); err != nil {
+		reply(fmt.Sprintf("Switched %s but failed to save it: %s", coll.Commands[0], err))
+		return err
+	}
+	reply(fmt.Sprintf(":ok_hand: %s is now %sd", coll.Commands[0], parts[1]))
+	return nil
+}
+
+func findControlCommand(name string) *ControlCommand {
+	for _, cmd := range CONTROL_COMMANDS {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Party plays random sounds in a voice channel at random intervals until it runs out of time
+// or someone stops it
+type Party struct {
+	GuildID     string
+	ChannelID   string
+	UserID      string
+	Collections []*SoundCollection
+	Until       time.Time
+
+	// The state of the session that started it
+	state *discordgo.State
+	stop  chan struct{}
+}
+
+var (
+	// Defaults for guilds that haven't set their own party limits (intervals are in seconds)
+	PARTY_MAX_MINUTES  = 30
+	PARTY_MIN_INTERVAL = 15
+	PARTY_MAX_INTERVAL = 60
+
+	// Parties currently going, keyed by guild id
+	parties      = make(map[string]*Party)
+	partiesMutex sync.Mutex
+
+	ErrPartyUsage = errors.New("Try `!party <minutes> [categories]` to start one and `!stop` to end it. Admins can use `!party max <minutes>`, `!party interval <min>-<max>` (in seconds) and `!party allow <categories|all>`.")
+)
+
+// Returns the party going in a guild, if any
+func getParty(guildID string) *Party {
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+	return parties[guildID]
+}
+
+// The party limits for a guild, with defaults filled in
+func partyLimits(settings *GuildSettings) (maxMinutes, minInterval, maxInterval int) {
+	maxMinutes, minInterval, maxInterval = PARTY_MAX_MINUTES, PARTY_MIN_INTERVAL, PARTY_MAX_INTERVAL
+	if settings.PartyMaxMinutes > 0 {
+		maxMinutes = settings.PartyMaxMinutes
+	}
+
+	if settings.PartyMinInterval > 0 && settings.PartyMaxInterval >= settings.PartyMinInterval {
+		minInterval, maxInterval = settings.PartyMinInterval, settings.PartyMaxInterval
+	}
+	return
+}
+
+// Drops one random sound every so often until the party ends
+func (p *Party) run(minInterval, maxInterval int) {
+	defer func() {
+		partiesMutex.Lock()
+		if parties[p.GuildID] == p {
+			delete(parties, p.GuildID)
+		}
+		partiesMutex.Unlock()
+	}()
+
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-shutdownStarted:
+			return
+		case <-time.After(wait):
+		}
+
+		if time.Now().After(p.Until) || !channelHasHumans(p.state, p.GuildID, p.ChannelID) {
+			return
+		}
+		p.drop()
+
+		wait = time.Second * time.Duration(minInterval)
+		if maxInterval > minInterval {
+			wait = time.Second * time.Duration(randomRange(minInterval, maxInterval+1))
+		}
+	}
+}
+
+// Plays a random sound from one of the party's collections
+func (p *Party) drop() {
+	guild, _ := p.state.Guild(p.GuildID)
+	channel, _ := p.state.Channel(p.ChannelID)
+	if guild == nil || channel == nil {
+		return
+	}
+
+	user := &discordgo.User{ID: p.UserID}
+	if member, _ := p.state.Member(p.GuildID, p.UserID); member != nil && member.User != nil {
+		user = member.User
+	}
+
+	coll := p.Collections[randomRange(0, len(p.Collections))]
+	play, err := preparePlay(p.state, user, guild, channel, coll, nil)
+	if err == nil {
+		play.tag("party")
+		_, err = enqueuePlay(play)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   p.GuildID,
+			"channel": p.ChannelID,
+			"error":   err,
+		}).Warning("Failed to drop party sound")
+	}
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:  "party",
+		Args:  "<minutes> [category...]",
+		Help:  "Drops random sounds in your voice channel for a while",
+		Usage: ErrPartyUsage.Error(),
+		Run:   handlePartyCommand,
+	})
+
+	registerCommand(&Command{
+		Name: "stop",
+		Help: "Ends the party or trivia game",
+		Run:  handleStopCommand,
+	})
+}
+
+// Handles `!party <minutes> [categories]`, and the admin only `!party max|interval|allow`
+func handlePartyCommand(c *CommandContext) error {
+	args := c.Args
+	if len(args) == 0 {
+		return ErrPartyUsage
+	}
+
+	switch args[0] {
+	case "max", "interval", "allow":
+		return configureParty(c)
+	}
+	return startParty(c)
+}
+
+func startParty(c *CommandContext) error {
+	args := c.Args
+	minutes, err := strconv.Atoi(args[0])
+	if err != nil || minutes <= 0 {
+		return ErrPartyUsage
+	}
+
+	settings := c.settings()
+	maxMinutes, minInterval, maxInterval := partyLimits(settings)
+	if minutes > maxMinutes {
+		return fmt.Errorf("Parties on this server can last at most %d minutes.", maxMinutes)
+	}
+
+	// Pick from the named collections, or everything the server allows
+	collections := make([]*SoundCollection, 0)
+	for _, name := range args[1:] {
+		coll := findGuildCollection(c.settings(), name)
+		if coll == nil {
+			return fmt.Errorf("I don't have a category called **%s**, try `!help`.", name)
+		} else if !coll.Enabled() {
+			return fmt.Errorf("`%s` is switched off right now.", coll.Commands[0])
+		} else if len(settings.PartyCollections) > 0 && !scontains(coll.Prefix, settings.PartyCollections...) {
+			return fmt.Errorf("**%s** isn't allowed at parties on this server.", name)
+		}
+		collections = append(collections, coll)
+	}
+
+	if len(collections) == 0 {
+		for _, coll := range guildCollections(c.settings()) {
+			if len(settings.PartyCollections) == 0 || scontains(coll.Prefix, settings.PartyCollections...) {
+				collections = append(collections, coll)
+			}
+		}
+	}
+
+	if len(collections) == 0 {
+		return errors.New("None of the allowed party categories exist anymore, ask an admin to `!party allow` some.")
+	}
+
+	channel := getCurrentVoiceChannel(c.State, c.Author, c.Guild)
+	if channel == nil {
+		return ErrNotInVoice
+	} else if err := checkVoicePermissions(c.State, c.State.Ready.User.ID, channel); err != nil {
+		return err
+	}
+
+	party := &Party{
+		GuildID:     c.Guild.ID,
+		ChannelID:   channel.ID,
+		UserID:      c.Author.ID,
+		Collections: collections,
+		Until:       time.Now().Add(time.Minute * time.Duration(minutes)),
+		state:       c.State,
+		stop:        make(chan struct{}),
+	}
+
+	partiesMutex.Lock()
+	if _, exists := parties[c.Guild.ID]; exists {
+		partiesMutex.Unlock()
+		return errors.New("There's already a party going, `!stop` it first.")
+	}
+	parties[c.Guild.ID] = party
+	partiesMutex.Unlock()
+
+	go party.run(minInterval, maxInterval)
+	c.Reply(fmt.Sprintf(":tada: Party in **%s** for %d minutes! `!stop` to end it.", channel.Name, minutes))
+	return nil
+}
+
+func configureParty(c *CommandContext) (err error) {
+	defer func() { c.audit(err) }()
+
+	args := c.Args
+	if !c.isGuildAdmin() {
+		return ErrNotGuildAdmin
+	} else if len(args) < 2 {
+		return ErrPartyUsage
+	}
+
+	var (
+		change func(*GuildSettings)
+		reply  string
+	)
+
+	switch args[0] {
+	case "max":
+		minutes, err := strconv.Atoi(args[1])
+		if err != nil || minutes <= 0 {
+			return ErrPartyUsage
+		}
+		change = func(gs *GuildSettings) { gs.PartyMaxMinutes = minutes }
+		reply = fmt.Sprintf(":ok_hand: Parties can now last up to %d minutes.", minutes)
+	case "interval":
+		bounds := strings.SplitN(args[1], "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		high := low
+		if err == nil && len(bounds) == 2 {
+			high, err = strconv.Atoi(bounds[1])
+		}
+
+		if err != nil || low <= 0 || high < low {
+			return errors.New("Try something like `!party interval 15-60` (in seconds).")
+		}
+		change = func(gs *GuildSettings) { gs.PartyMinInterval, gs.PartyMaxInterval = low, high }
+		reply = fmt.Sprintf(":ok_hand: Party sounds now drop every %d-%d seconds.", low, high)
+	case "allow":
+		allowed := make([]string, 0)
+		if args[1] != "all" {
+			for _, name := range args[1:] {
+				coll := findCollection(name)
+				if coll == nil {
+					return fmt.Errorf("I don't have a category called **%s**, try `!help`.", name)
+				}
+				allowed = append(allowed, coll.Prefix)
+			}
+		}
+		change = func(gs *GuildSettings) { gs.PartyCollections = allowed }
+		reply = ":ok_hand: Parties can now use every category."
+		if len(allowed) > 0 {
+			reply = fmt.Sprintf(":ok_hand: Parties can now use `%s`.", strings.Join(allowed, "`, `"))
+		}
+	}
+
+	if err := c.Settings.Update(c.Guild.ID, change); err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Handles `!stop`, ending the guild's party and trivia game
+func handleStopCommand(c *CommandContext) error {
+	partiesMutex.Lock()
+	party := parties[c.Guild.ID]
+	delete(parties, c.Guild.ID)
+	partiesMutex.Unlock()
+
+	stoppedTrivia := stopTrivia(getGuildTriviaGame(c.Guild.ID))
+	if party == nil && !stoppedTrivia {
+		return errors.New("There's nothing to stop.")
+	}
+
+	if party != nil {
+		close(party.stop)
+		c.Reply(":pensive: Party's over.")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolicyError is returned when a guild or catalog policy blocks a play
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+var (
+	// When each sound and collection's cooldown ends, keyed by guild and policy key
+	policyCooldownEnds      = make(map[string]time.Time)
+	policyCooldownEndsMutex sync.Mutex
+
+	ErrPolicyUsage = errors.New("Try `!policy`, `!policy cooldown <category> [sound] <duration|off>`, `!policy maxlength <duration|off>` or `!policy long <duration> <cooldown>` (`!policy long off` to remove it).")
+)
+
+func soundPolicyKey(coll *SoundCollection, sound *Sound) string {
+	return coll.Prefix + " " + sound.Name
+}
+
+// Checks every play in a chain against the catalog and guild policies, and if they all pass,
+// starts their cooldowns, returning a function that gives them back for a play that doesn't
+// get queued after all. Anything with a cooldown can only be in a chain once, otherwise
+// `!penis jerk x10` would get around it.
+func applyPolicies(play *Play) (release func(), err error) {
+	settings := getGuildSettings(play.GuildID)
+	cooldowns := make(map[string]time.Duration)
+	counts := make(map[string]int)
+
+	for p := play; p != nil; p = p.Next {
+		if p.Collection == nil {
+			continue
+		}
+
+		if !collectionAllowed(settings, p.Collection) {
+			return nil, &PolicyError{fmt.Sprintf("`%s` isn't allowed on this server.", p.Collection.Commands[0])}
+		} else if !p.Collection.Enabled() {
+			return nil, &PolicyError{fmt.Sprintf("`%s` is switched off right now.", p.Collection.Commands[0])}
+		} else if err := collectionRoleAllowed(liveState(), settings, play, p.Collection); err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprintf("%s %s", p.Collection.Commands[0], p.Sound.Name)
+		duration := p.Sound.FramesDuration(p.Start, p.End)
+		if settings.MaxDuration > 0 && duration > settings.MaxDuration {
+			return nil, &PolicyError{fmt.Sprintf("**%s** is %s long, this server only allows clips up to %s.", name, formatTimestamp(duration), formatTimestamp(settings.MaxDuration))}
+		}
+
+		soundCooldown := maxDuration(p.Sound.Cooldown, settings.SoundCooldowns[soundPolicyKey(p.Collection, p.Sound)])
+		if settings.LongSound > 0 && duration > settings.LongSound {
+			soundCooldown = maxDuration(soundCooldown, settings.LongSoundCooldown)
+		}
+
+		soundKey, collKey := "sound:"+soundPolicyKey(p.Collection, p.Sound), "collection:"+p.Collection.Prefix
+		counts[soundKey]++
+		counts[collKey]++
+
+		if soundCooldown > 0 {
+			cooldowns[soundKey] = soundCooldown
+		}
+
+		if collCooldown := settings.CollectionCooldowns[p.Collection.Prefix]; collCooldown > 0 {
+			cooldowns[collKey] = collCooldown
+		}
+	}
+
+	policyCooldownEndsMutex.Lock()
+	defer policyCooldownEndsMutex.Unlock()
+
+	now := time.Now()
+	for key, cooldown := range cooldowns {
+		what := strings.SplitN(key, ":", 2)[1]
+		if counts[key] > 1 {
+			return nil, &PolicyError{fmt.Sprintf("**%s** can only be played once every %s here, so it can only be in a command once.", what, cooldown)}
+		}
+
+		if left := policyCooldownEnds[play.GuildID+":"+key].Sub(now); left > 0 {
+			return nil, &PolicyError{fmt.Sprintf("**%s** can only be played once every %s here, try again in %s.", what, cooldown, left.Round(time.Second))}
+		}
+	}
+
+	// Cooldowns that have ended are forgotten, so this only holds what's cooling down
+	for key, end := range policyCooldownEnds {
+		if !end.After(now) {
+			delete(policyCooldownEnds, key)
+		}
+	}
+
+	started := make([]string, 0, len(cooldowns))
+	for key, cooldown := range cooldowns {
+		policyCooldownEnds[play.GuildID+":"+key] = now.Add(cooldown)
+		started = append(started, play.GuildID+":"+key)
+	}
+
+	return func() {
+		policyCooldownEndsMutex.Lock()
+		defer policyCooldownEndsMutex.Unlock()
+
+		for _, key := range started {
+			delete(policyCooldownEnds, key)
+		}
+	}, nil
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Parses a duration argument, where `off` (or 0) means no limit
+func parsePolicyDuration(arg string) (time.Duration, error) {
+	if arg == "off" || arg == "0" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(arg)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("**%s** isn't a duration, try something like `30s` or `1h`.", arg)
+	}
+	return d, nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:  "policy",
+		Args:  "[cooldown|maxlength|long ...]",
+		Help:  "Shows or sets limits on long and loud clips",
+		Usage: ErrPolicyUsage.Error(),
+		Run:   handlePolicyCommand,
+	})
+}
+
+// Handles `!policy` (which lists the guild's policies) and the admin only
+// `!policy cooldown|maxlength|long` commands
+func handlePolicyCommand(c *CommandContext) error {
+	args := c.Args
+	if len(args) == 0 || args[0] == "list" {
+		c.Reply(describePolicies(c.settings()))
+		return nil
+	}
+
+	if !c.isGuildAdmin() {
+		c.audit(ErrNotGuildAdmin)
+		return ErrNotGuildAdmin
+	}
+
+	var (
+		change func(*GuildSettings)
+		reply  string
+		err    error
+	)
+
+	switch {
+	case args[0] == "cooldown" && (len(args) == 3 || len(args) == 4):
+		var (
+			ref      *SoundRef
+			cooldown time.Duration
+		)
+
+		if ref, err = parseSoundRef(args[1 : len(args)-1]); err != nil {
+			break
+		} else if cooldown, err = parsePolicyDuration(args[len(args)-1]); err != nil {
+			break
+		}
+
+		change = func(gs *GuildSettings) {
+			target := &gs.CollectionCooldowns
+			key := ref.Collection
+			if ref.Sound != "" {
+				target, key = &gs.SoundCooldowns, ref.String()
+			}
+
+			if *target == nil {
+				*target = make(map[string]time.Duration)
+			}
+
+			if cooldown == 0 {
+				delete(*target, key)
+			} else {
+				(*target)[key] = cooldown
+			}
+		}
+		reply = fmt.Sprintf(":ok_hand: `%s` cooldown set to %s.", ref, cooldown)
+	case args[0] == "maxlength" && len(args) == 2:
+		var limit time.Duration
+		if limit, err = parsePolicyDuration(args[1]); err != nil {
+			break
+		}
+		change = func(gs *GuildSettings) { gs.MaxDuration = limit }
+		reply = fmt.Sprintf(":ok_hand: Clips can now be up to %s long (0 means no limit).", limit)
+	case args[0] == "long" && len(args) == 2 && args[1] == "off":
+		change = func(gs *GuildSettings) { gs.LongSound, gs.LongSoundCooldown = 0, 0 }
+		reply = ":ok_hand: Long clips no longer have their own cooldown."
+	case args[0] == "long" && len(args) == 3:
+		var long, cooldown time.Duration
+		if long, err = parsePolicyDuration(args[1]); err != nil {
+			break
+		} else if cooldown, err = parsePolicyDuration(args[2]); err != nil {
+			break
+		}
+		change = func(gs *GuildSettings) { gs.LongSound, gs.LongSoundCooldown = long, cooldown }
+		reply = fmt.Sprintf(":ok_hand: Clips over %s can now be played once every %s.", long, cooldown)
+	default:
+		err = ErrPolicyUsage
+	}
+
+	if err == nil {
+		err = c.Settings.Update(c.Guild.ID, change)
+	}
+	c.audit(err)
+
+	if err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Lists a guild's play policies
+func describePolicies(settings *GuildSettings) string {
+	lines := make([]string, 0)
+	if settings.MaxDuration > 0 {
+		lines = append(lines, fmt.Sprintf("Clips can be at most %s long.", settings.MaxDuration))
+	}
+
+	if settings.LongSound > 0 {
+		lines = append(lines, fmt.Sprintf("Clips over %s can be played once every %s.", settings.LongSound, settings.LongSoundCooldown))
+	}
+
+	cooldowns := make([]string, 0)
+	for key, cooldown := range settings.CollectionCooldowns {
+		cooldowns = append(cooldowns, fmt.Sprintf("`%s` can be played once every %s.", key, cooldown))
+	}
+
+	for key, cooldown := range settings.SoundCooldowns {
+		cooldowns = append(cooldowns, fmt.Sprintf("`%s` can be played once every %s.", key, cooldown))
+	}
+	sort.Strings(cooldowns)
+
+	if lines = append(lines, cooldowns...); len(lines) == 0 {
+		return "No play policies are set on this server."
+	}
+	return strings.Join(lines, "\n")
+}
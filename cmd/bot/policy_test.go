@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Checks a play against the policies, keeping any cooldowns it starts
+func checkPolicies(play *Play) error {
+	_, err := applyPolicies(play)
+	return err
+}
+
+// Chains a sound onto itself, like `!penis jerk x3`
+func repeatedPlay(guildID string, coll *SoundCollection, sound *Sound, times int) *Play {
+	play := &Play{GuildID: guildID, Collection: coll, Sound: sound}
+	for i := 1; i < times; i++ {
+		play.Append(coll, sound)
+	}
+	return play
+}
+
+func TestApplyPoliciesRejectsRepeatedSoundOnCooldown(t *testing.T) {
+	const guildID = "policy-sound-repeat"
+	PENIS.SetEnabled(true)
+	jerk := PENIS.Find("jerk")
+
+	updateGuildSettings(guildID, func(gs *GuildSettings) {
+		gs.SoundCooldowns = map[string]time.Duration{soundPolicyKey(PENIS, jerk): time.Hour}
+	})
+
+	if _, ok := checkPolicies(repeatedPlay(guildID, PENIS, jerk, 3)).(*PolicyError); !ok {
+		t.Fatal("jerk x3 should be rejected when jerk has a cooldown")
+	}
+
+	// The rejected chain shouldn't have started the cooldown
+	if err := checkPolicies(repeatedPlay(guildID, PENIS, jerk, 1)); err != nil {
+		t.Fatalf("a single jerk should play, got %v", err)
+	}
+
+	if _, ok := checkPolicies(repeatedPlay(guildID, PENIS, jerk, 1)).(*PolicyError); !ok {
+		t.Fatal("jerk should be rejected while it's cooling down")
+	}
+}
+
+func TestApplyPoliciesRejectsRepeatedCollectionOnCooldown(t *testing.T) {
+	const guildID = "policy-collection-repeat"
+	AIRHORN.SetEnabled(true)
+
+	updateGuildSettings(guildID, func(gs *GuildSettings) {
+		gs.CollectionCooldowns = map[string]time.Duration{AIRHORN.Prefix: time.Minute}
+	})
+
+	play := &Play{GuildID: guildID, Collection: AIRHORN, Sound: AIRHORN.Find("truck")}
+	play.Append(AIRHORN, AIRHORN.Find("default"))
+	if _, ok := checkPolicies(play).(*PolicyError); !ok {
+		t.Fatal("two airhorns in one command should be rejected when airhorn has a cooldown")
+	}
+}
+
+func TestApplyPoliciesAllowsRepeatsWithoutCooldown(t *testing.T) {
+	AIRHORN.SetEnabled(true)
+	truck := AIRHORN.Find("truck")
+
+	if err := checkPolicies(repeatedPlay("policy-no-cooldown", AIRHORN, truck, 3)); err != nil {
+		t.Fatalf("truck x3 should play without a cooldown, got %v", err)
+	}
+}
+
+func TestApplyPoliciesReleaseGivesCooldownsBack(t *testing.T) {
+	const guildID = "policy-release"
+	PENIS.SetEnabled(true)
+	jerk := PENIS.Find("jerk")
+
+	// jerk has a cooldown in the catalog, without the guild setting one
+	release, err := applyPolicies(repeatedPlay(guildID, PENIS, jerk, 1))
+	if err != nil {
+		t.Fatalf("jerk should play, got %v", err)
+	}
+
+	if _, ok := checkPolicies(repeatedPlay(guildID, PENIS, jerk, 1)).(*PolicyError); !ok {
+		t.Fatal("jerk should be on its catalog cooldown")
+	}
+
+	release()
+	if err := checkPolicies(repeatedPlay(guildID, PENIS, jerk, 1)); err != nil {
+		t.Fatalf("a play that wasn't queued shouldn't use up the cooldown, got %v", err)
+	}
+}
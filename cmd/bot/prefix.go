@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Prefix for guilds that haven't picked their own
+	DEFAULT_PREFIX = "!"
+
+	MAX_PREFIX_LENGTH = 5
+	MAX_ALIASES       = 50
+)
+
+var (
+	ErrPrefixUsage = errors.New("Try `!prefix` to see it, `!prefix <prefix>` to change it (eg `!prefix ?` or `!prefix horn!`) or `!prefix reset`.")
+	ErrAliasUsage  = errors.New("Try `!alias`, `!alias <name> <command> [args]` (eg `!alias horn airhorn`) or `!alias remove <name>`.")
+
+	// A command or category mentioned in text for users, like the `!help` in "try `!help`"
+	commandMention = regexp.MustCompile("(^|[\\s`(])!([a-z]+)")
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:  "prefix",
+		Args:  "[prefix|reset]",
+		Help:  "Shows or changes the prefix commands start with on this server",
+		Usage: ErrPrefixUsage.Error(),
+		Run:   handlePrefixCommand,
+	})
+
+	registerCommand(&Command{
+		Name:  "alias",
+		Args:  "[<name> <command> [args]|remove <name>]",
+		Help:  "Shows or sets up other names for commands on this server",
+		Usage: ErrAliasUsage.Error(),
+		Run:   handleAliasCommand,
+	})
+}
+
+// The prefix commands start with in a guild
+func guildPrefix(settings *GuildSettings) string {
+	if settings.Prefix == "" {
+		return DEFAULT_PREFIX
+	}
+	return settings.Prefix
+}
+
+// Rewrites a message using its guild's prefix and aliases into the plain `!command` form the
+// rest of the bot expects, and reports whether it's a command at all. Messages that aren't
+// commands are returned untouched.
+func applyGuildPrefix(m *discordgo.MessageCreate) (*discordgo.MessageCreate, bool) {
+	settings := &GuildSettings{}
+	if channel, _ := discord.State.Channel(m.ChannelID); channel != nil && channel.GuildID != "" {
+		settings = getGuildSettings(channel.GuildID)
+	}
+
+	// Compared without lowercasing the whole message, since that can change its length and
+	// throw off where the prefix ends
+	prefix := guildPrefix(settings)
+	if len(m.Content) < len(prefix) || !strings.EqualFold(m.Content[:len(prefix)], prefix) {
+		return m, false
+	}
+
+	words := strings.Fields(m.Content[len(prefix):])
+	if len(words) == 0 {
+		return m, false
+	}
+
+	if target, ok := settings.Aliases[strings.ToLower(words[0])]; ok {
+		words = append(strings.Fields(target), words[1:]...)
+	}
+
+	// Copy the message so the original in the state cache is left alone
+	message := *m.Message
+	message.Content = DEFAULT_PREFIX + strings.Join(words, " ")
+	return &discordgo.MessageCreate{Message: &message}, true
+}
+
+func isPrefixSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Handles `!prefix` and the admin only `!prefix <prefix>` and `!prefix reset`
+func handlePrefixCommand(c *CommandContext) error {
+	if len(c.Args) == 0 {
+		c.Reply(fmt.Sprintf("Commands start with `%s` on this server.", guildPrefix(c.settings())))
+		return nil
+	}
+
+	if !c.isGuildAdmin() {
+		c.audit(ErrNotGuildAdmin)
+		return ErrNotGuildAdmin
+	}
+
+	prefix := c.Args[0]
+	if len(c.Args) > 1 {
+		return ErrPrefixUsage
+	} else if prefix == "reset" {
+		prefix = DEFAULT_PREFIX
+	} else if len(prefix) > MAX_PREFIX_LENGTH {
+		return fmt.Errorf("Prefixes can be at most %d characters.", MAX_PREFIX_LENGTH)
+	} else if strings.IndexFunc(prefix, isPrefixSymbol) < 0 {
+		// Otherwise a prefix like `a` would swallow every message starting with an a
+		return errors.New("Prefixes need a symbol in them, like `?` or `horn!`.")
+	}
+
+	err := c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+		gs.Prefix = prefix
+		if prefix == DEFAULT_PREFIX {
+			gs.Prefix = ""
+		}
+	})
+	c.audit(err)
+
+	if err != nil {
+		return err
+	}
+	c.Reply(fmt.Sprintf(":ok_hand: Commands now start with `%s`, like `%sairhorn`.", prefix, prefix))
+	return nil
+}
+
+// Handles `!alias` and the admin only `!alias <name> <command> [args]` and `!alias remove <name>`
+func handleAliasCommand(c *CommandContext) error {
+	if len(c.Args) == 0 {
+		c.Reply(describeAliases(c.settings()))
+		return nil
+	}
+
+	if !c.isGuildAdmin() {
+		c.audit(ErrNotGuildAdmin)
+		return ErrNotGuildAdmin
+	}
+
+	var (
+		change func(*GuildSettings)
+		reply  string
+		err    error
+	)
+
+	switch {
+	case len(c.Args) == 2 && scontains(c.Args[0], "remove", "rm", "delete"):
+		name := trimCommandPrefix(c.settings(), c.Args[1])
+		if _, ok := c.settings().Aliases[name]; !ok {
+			err = fmt.Errorf("There's no alias called **%s**.", name)
+			break
+		}
+
+		change = func(gs *GuildSettings) { delete(gs.Aliases, name) }
+		reply = fmt.Sprintf(":ok_hand: Removed the `%s` alias.", name)
+	case len(c.Args) >= 2:
+		name := trimCommandPrefix(c.settings(), c.Args[0])
+		target := trimCommandPrefix(c.settings(), strings.Join(c.Args[1:], " "))
+		command := strings.Fields(target)[0]
+
+		if findCommand(name) != nil || findCollection(name) != nil {
+			err = fmt.Errorf("**%s** is already a command.", name)
+		} else if findCommand(command) == nil && findCollection(command) == nil {
+			err = fmt.Errorf("I don't have a command or category called **%s**.", command)
+		} else if len(c.settings().Aliases) >= MAX_ALIASES {
+			err = fmt.Errorf("This server already has %d aliases, remove some first.", MAX_ALIASES)
+		}
+
+		if err != nil {
+			break
+		}
+
+		change = func(gs *GuildSettings) {
+			if gs.Aliases == nil {
+				gs.Aliases = make(map[string]string)
+			}
+			gs.Aliases[name] = target
+		}
+		reply = fmt.Sprintf(":ok_hand: `%s` now means `%s`.", name, target)
+	default:
+		err = ErrAliasUsage
+	}
+
+	if err == nil {
+		err = c.Settings.Update(c.Guild.ID, change)
+	}
+	c.audit(err)
+
+	if err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Strips the default or guild prefix from a command name
+func trimCommandPrefix(settings *GuildSettings, name string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(name, guildPrefix(settings)), DEFAULT_PREFIX)
+}
+
+// Lists a guild's aliases
+func describeAliases(settings *GuildSettings) string {
+	if len(settings.Aliases) == 0 {
+		return "There are no aliases on this server."
+	}
+
+	lines := make([]string, 0, len(settings.Aliases))
+	for name, target := range settings.Aliases {
+		lines = append(lines, fmt.Sprintf("`%s` means `%s`", name, target))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Rewrites the `!command` hints in text for a guild to use its prefix. Only names of commands
+// and categories are touched, so a sound transcript shouting "Smoothie!" is left alone.
+func renderPrefix(settings *GuildSettings, text string) string {
+	prefix := guildPrefix(settings)
+	if prefix == DEFAULT_PREFIX {
+		return text
+	}
+
+	return commandMention.ReplaceAllStringFunc(text, func(match string) string {
+		parts := commandMention.FindStringSubmatch(match)
+		if findCommand(parts[2]) == nil && findCollection(parts[2]) == nil {
+			return match
+		}
+		return parts[1] + prefix + parts[2]
+	})
+}
+
+// Renders an embed like renderPrefix, copying it so the original (eg a help page) is left alone
+func renderPrefixEmbed(settings *GuildSettings, embed *discordgo.MessageEmbed) *discordgo.MessageEmbed {
+	rendered := *embed
+	rendered.Title = renderPrefix(settings, embed.Title)
+	rendered.Description = renderPrefix(settings, embed.Description)
+	if embed.Footer != nil {
+		footer := *embed.Footer
+		footer.Text = renderPrefix(settings, footer.Text)
+		rendered.Footer = &footer
+	}
+	return &rendered
+}
+
+// An error whose text has been rendered with a guild's prefix, still matching the original
+// with errors.Is
+type prefixedError struct {
+	error
+	text string
+}
+
+func (e *prefixedError) Error() string {
+	return e.text
+}
+
+func (e *prefixedError) Unwrap() error {
+	return e.error
+}
+
+// Renders an error like renderPrefix, returning it untouched if nothing changed
+func renderPrefixError(settings *GuildSettings, err error) error {
+	if err == nil {
+		return nil
+	} else if text := renderPrefix(settings, err.Error()); text != err.Error() {
+		return &prefixedError{err, text}
+	}
+	return err
+}
+
+// Responder that renders everything a command in a guild sends with the guild's prefix. The
+// settings are looked up as it goes, so a reply to `!prefix` already uses the new one.
+type prefixedResponder struct {
+	Responder
+	settings SettingsStore
+	guildID  string
+}
+
+func (r *prefixedResponder) Reply(text string) (*discordgo.Message, error) {
+	return r.Responder.Reply(renderPrefix(r.settings.Get(r.guildID), text))
+}
+
+func (r *prefixedResponder) ReplyEmbed(embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return r.Responder.ReplyEmbed(renderPrefixEmbed(r.settings.Get(r.guildID), embed))
+}
+
+func (r *prefixedResponder) Edit(messageID, text string) (*discordgo.Message, error) {
+	return r.Responder.Edit(messageID, renderPrefix(r.settings.Get(r.guildID), text))
+}
+
+func (r *prefixedResponder) EditEmbed(messageID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return r.Responder.EditEmbed(messageID, renderPrefixEmbed(r.settings.Get(r.guildID), embed))
+}
+
+func (r *prefixedResponder) Reject(err error) {
+	r.Responder.Reject(renderPrefixError(r.settings.Get(r.guildID), err))
+}
+
+// DMs about a guild, like `!help dm`, describe its commands so they use its prefix too
+func (r *prefixedResponder) DirectMessage(userID string) (Responder, error) {
+	dm, err := r.Responder.DirectMessage(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &prefixedResponder{Responder: dm, settings: r.settings, guildID: r.guildID}, nil
+}
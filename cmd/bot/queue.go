@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name: "queue",
+		Help: "Shows what's playing and what's waiting to play",
+		Run: func(c *CommandContext) error {
+			c.Reply(describeQueue(c.State, c.Guild.ID))
+			return nil
+		},
+	})
+}
+
+// Describes a play and anything chained on to it, eg `!airhorn default, !airhorn truck`
+func describePlay(play *Play) string {
+	sounds := make([]string, 0)
+	for p := play; p != nil; p = p.Next {
+		// Naming a trivia sound would give the answer away
+		if p.Source == "trivia" {
+			sounds = append(sounds, "a mystery sound")
+		} else if p.Collection == nil {
+			sounds = append(sounds, p.Sound.Name)
+		} else {
+			sounds = append(sounds, fmt.Sprintf("%s %s", p.Collection.Commands[0], p.Sound.Name))
+		}
+	}
+	return strings.Join(sounds, ", ")
+}
+
+// Lists what a guild is playing and what's queued after it
+func describeQueue(state *discordgo.State, guildID string) string {
+	current, waiting := guildQueue(guildID)
+	if current == nil {
+		return "Nothing is playing right now."
+	}
+
+	lines := []string{fmt.Sprintf(":loud_sound: Playing **%s** for %s", describePlay(current), memberName(state, guildID, current.UserID))}
+	for i, play := range waiting {
+		lines = append(lines, fmt.Sprintf("%d. **%s** for %s", i+1, describePlay(play), memberName(state, guildID, play.UserID)))
+	}
+
+	if len(waiting) == 0 {
+		lines = append(lines, "Nothing else is queued.")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A guild member's nickname or username, without pinging them like a mention would
+func memberName(state *discordgo.State, guildID, userID string) string {
+	member, err := state.Member(guildID, userID)
+	if err != nil || member.User == nil {
+		return "someone"
+	} else if member.Nick != "" {
+		return member.Nick
+	}
+	return member.User.Username
+}
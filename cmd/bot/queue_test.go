@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestDescribePlayHidesTrivia(t *testing.T) {
+	play := &Play{Collection: AIRHORN, Sound: AIRHORN.Find("truck")}
+	if described := describePlay(play); described != "!airhorn truck" {
+		t.Fatalf("got %q, want %q", described, "!airhorn truck")
+	}
+
+	play.tag("trivia")
+	if described := describePlay(play); described != "a mystery sound" {
+		t.Fatalf("trivia sounds shouldn't be named in the queue, got %q", described)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	ErrNotServerAdmin = errors.New("Only people who can manage this server can do that.")
+	ErrRolesUsage     = errors.New("Try `!roles`, `!roles admin @role` (`!roles admin off` to remove it), `!roles restrict <command|category> @role...` or `!roles open <command|category>`.")
+)
+
+// The live session's state, or nil before we've connected, in which case lookups just fail
+func liveState() *discordgo.State {
+	if discord == nil {
+		return nil
+	}
+	return discord.State
+}
+
+// Whether a user is an admin operator or can manage the guild the channel is in, ignoring the
+// bot admin role
+func isServerAdmin(state *discordgo.State, userID, channelID string) bool {
+	if operatorLevel(userID) >= OPERATOR_ADMIN {
+		return true
+	}
+
+	perms, err := state.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		return false
+	}
+	return perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0
+}
+
+// Whether a member of a guild has any of the given roles. This is checked for every play, so it
+// only looks in the state cache, and someone who isn't cached is treated as having no roles.
+func memberHasRole(state *discordgo.State, guildID, userID string, roles []string) bool {
+	if len(roles) == 0 {
+		return false
+	}
+
+	member, err := state.Member(guildID, userID)
+	if err != nil {
+		return false
+	}
+
+	for _, role := range member.Roles {
+		if scontains(role, roles...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the name a command or category is restricted under, `!dectalk` or `dectalk` for the
+// collection and `!party` or `party` for the command
+func restrictionKey(name string) (key string, isCollection bool) {
+	name = strings.TrimPrefix(name, "!")
+	if coll := findCollection(name); coll != nil {
+		return coll.Prefix, true
+	}
+
+	if cmd := findCommand(name); cmd != nil {
+		return cmd.Name, false
+	}
+	return "", false
+}
+
+// Checks whether a user may run a bot command (eg `!party`) in a guild with these settings.
+// Admins can always run everything.
+func commandAllowed(state *discordgo.State, settings *GuildSettings, guildID, userID, channelID, command string) bool {
+	roles, ok := settings.CommandRoles[strings.TrimPrefix(command, "!")]
+	return !ok || memberHasRole(state, guildID, userID, roles) || isGuildAdmin(state, settings, userID, channelID)
+}
+
+// Checks whether the user behind a play may play sounds from a collection in a guild with these
+// settings. Admins can always play everything.
+func collectionRoleAllowed(state *discordgo.State, settings *GuildSettings, play *Play, coll *SoundCollection) error {
+	roles, ok := settings.CollectionRoles[coll.Prefix]
+	if !ok || memberHasRole(state, play.GuildID, play.UserID, roles) || isGuildAdmin(state, settings, play.UserID, play.ChannelID) {
+		return nil
+	}
+	return &PolicyError{fmt.Sprintf("`%s` can only be played by %s here.", coll.Commands[0], describeRoles(state, play.GuildID, roles))}
+}
+
+// Lists roles by name, falling back to their ids if they've gone
+func describeRoles(state *discordgo.State, guildID string, roles []string) string {
+	names := make([]string, 0, len(roles))
+	for _, id := range roles {
+		if role, err := state.Role(guildID, id); err == nil {
+			names = append(names, "@"+role.Name)
+		} else {
+			names = append(names, id)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:  "roles",
+		Args:  "[admin|restrict|open ...]",
+		Help:  "Shows or sets which roles can use what",
+		Usage: ErrRolesUsage.Error(),
+		Run:   handleRolesCommand,
+	})
+}
+
+// Handles `!roles` (which lists the guild's role rules) and the admin only
+// `!roles admin|restrict|open` commands
+func handleRolesCommand(c *CommandContext) error {
+	args := c.Args
+	if len(args) == 0 {
+		c.Reply(describeRoleRules(c.State, c.Guild.ID, c.settings()))
+		return nil
+	}
+
+	var (
+		change func(*GuildSettings)
+		reply  string
+		err    error
+	)
+
+	switch {
+	case args[0] == "admin" && len(args) == 2 && args[1] == "off":
+		if !c.isServerAdmin() {
+			err = ErrNotServerAdmin
+			break
+		}
+		change = func(gs *GuildSettings) { gs.AdminRole = "" }
+		reply = ":ok_hand: Only people who can manage the server can change my settings now."
+	case args[0] == "admin" && len(c.MentionRoles) == 1:
+		// Handing out admin is kept to people who already manage the server
+		if !c.isServerAdmin() {
+			err = ErrNotServerAdmin
+			break
+		}
+		role := c.MentionRoles[0]
+		change = func(gs *GuildSettings) { gs.AdminRole = role }
+		reply = fmt.Sprintf(":ok_hand: %s can now change my settings on this server.", describeRoles(c.State, c.Guild.ID, []string{role}))
+	case args[0] == "restrict" && len(args) > 1 && len(c.MentionRoles) > 0:
+		if !c.isGuildAdmin() {
+			err = ErrNotGuildAdmin
+			break
+		}
+
+		key, isCollection := restrictionKey(args[1])
+		if key == "" {
+			err = fmt.Errorf("I don't have a command or category called **%s**.", args[1])
+			break
+		}
+
+		roles := c.MentionRoles
+		change = func(gs *GuildSettings) {
+			target := &gs.CommandRoles
+			if isCollection {
+				target = &gs.CollectionRoles
+			}
+
+			if *target == nil {
+				*target = make(map[string][]string)
+			}
+			(*target)[key] = roles
+		}
+		reply = fmt.Sprintf(":ok_hand: `%s` is now only for %s.", key, describeRoles(c.State, c.Guild.ID, roles))
+	case args[0] == "open" && len(args) == 2:
+		if !c.isGuildAdmin() {
+			err = ErrNotGuildAdmin
+			break
+		}
+
+		key, _ := restrictionKey(args[1])
+		if key == "" {
+			err = fmt.Errorf("I don't have a command or category called **%s**.", args[1])
+			break
+		}
+
+		change = func(gs *GuildSettings) {
+			delete(gs.CommandRoles, key)
+			delete(gs.CollectionRoles, key)
+		}
+		reply = fmt.Sprintf(":ok_hand: Everyone can use `%s` again.", key)
+	default:
+		err = ErrRolesUsage
+	}
+
+	if err == nil {
+		err = c.Settings.Update(c.Guild.ID, change)
+	}
+	c.audit(err)
+
+	if err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Lists a guild's bot admin role and restricted commands and categories
+func describeRoleRules(state *discordgo.State, guildID string, settings *GuildSettings) string {
+	lines := make([]string, 0)
+	if settings.AdminRole != "" {
+		lines = append(lines, fmt.Sprintf("%s can change my settings.", describeRoles(state, guildID, []string{settings.AdminRole})))
+	}
+
+	rules := make([]string, 0)
+	for key, roles := range settings.CommandRoles {
+		rules = append(rules, fmt.Sprintf("`!%s` is only for %s.", key, describeRoles(state, guildID, roles)))
+	}
+
+	for key, roles := range settings.CollectionRoles {
+		rules = append(rules, fmt.Sprintf("`%s` sounds are only for %s.", key, describeRoles(state, guildID, roles)))
+	}
+	sort.Strings(rules)
+
+	if lines = append(lines, rules...); len(lines) == 0 {
+		return "Everyone can use every command and category on this server."
+	}
+	return strings.Join(lines, "\n")
+}
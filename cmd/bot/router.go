@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// CommandPermission is who can run a command, on top of any role rules the guild sets up
+type CommandPermission int
+
+const (
+	PERMISSION_EVERYONE CommandPermission = iota
+
+	// Guild admins, see isGuildAdmin
+	PERMISSION_GUILD_ADMIN
+)
+
+// Command is a bot command like `!party`. Commands register themselves with registerCommand,
+// and the router takes care of permissions, cooldowns and reporting errors so handlers only
+// have to do their own thing.
+type Command struct {
+	Name    string
+	Aliases []string
+
+	// Arguments for the help text, eg `<minutes> [category...]`
+	Args string
+
+	// One line description for `!help`, and longer usage for `!help <command>`
+	Help  string
+	Usage string
+
+	Permission CommandPermission
+
+	// How long each user has to wait between uses
+	Cooldown time.Duration
+
+	// Whether it also works in DMs, where the context has no guild
+	DirectMessages bool
+
+	// Runs the command. Returned errors are shown to the user as a rejection.
+	Run func(c *CommandContext) error
+}
+
+// Responder sends a command's replies and reactions. Commands only talk back through this, so
+// they can be run against a stand-in instead of a live session.
+type Responder interface {
+	Reply(text string) (*discordgo.Message, error)
+	ReplyEmbed(embed *discordgo.MessageEmbed) (*discordgo.Message, error)
+
+	// Changes a message sent with Reply or ReplyEmbed
+	Edit(messageID, text string) (*discordgo.Message, error)
+	EditEmbed(messageID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error)
+
+	// Adds reactions to a message in the channel, in the background since they're rate limited
+	React(messageID string, emoji ...string)
+
+	// Marks the command as rejected and explains why
+	Reject(err error)
+
+	// A responder for a DM with the user
+	DirectMessage(userID string) (Responder, error)
+}
+
+// SettingsStore loads and changes guild settings, see getGuildSettings
+type SettingsStore interface {
+	Get(guildID string) *GuildSettings
+	Update(guildID string, change func(*GuildSettings)) error
+}
+
+// AuditSink records what admins do, see audit
+type AuditSink interface {
+	Record(actorID, guildID, action string, args []string, err error)
+}
+
+// CommandContext is everything a command gets to work with. Commands look things up through
+// it rather than the live session, so they can be run against stand-ins.
+type CommandContext struct {
+	*discordgo.MessageCreate
+	Responder
+
+	// Cached guilds, channels and members, for permission and role checks
+	State *discordgo.State
+
+	Settings SettingsStore
+	Audit    AuditSink
+
+	// Nil in DMs
+	Guild *discordgo.Guild
+
+	// Lowercased words after the command
+	Args []string
+}
+
+// A context for a message the session received, backed by redis and the audit log
+func newCommandContext(s *discordgo.Session, m *discordgo.MessageCreate, guild *discordgo.Guild) *CommandContext {
+	return &CommandContext{
+		MessageCreate: m,
+		Responder:     &channelResponder{session: s, channelID: m.ChannelID, message: m.Message},
+		State:         s.State,
+		Settings:      redisSettings{},
+		Audit:         auditLog{},
+		Guild:         guild,
+		Args:          commandArgs(m),
+	}
+}
+
+// Replies in the channel the command came from
+type channelResponder struct {
+	session   *discordgo.Session
+	channelID string
+
+	// The command being answered, nil in DMs we opened
+	message *discordgo.Message
+}
+
+func (r *channelResponder) Reply(text string) (*discordgo.Message, error) {
+	return r.session.ChannelMessageSend(r.channelID, text)
+}
+
+func (r *channelResponder) ReplyEmbed(embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return r.session.ChannelMessageSendEmbed(r.channelID, embed)
+}
+
+func (r *channelResponder) Edit(messageID, text string) (*discordgo.Message, error) {
+	return r.session.ChannelMessageEdit(r.channelID, messageID, text)
+}
+
+func (r *channelResponder) EditEmbed(messageID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return r.session.ChannelMessageEditEmbed(r.channelID, messageID, embed)
+}
+
+func (r *channelResponder) React(messageID string, emoji ...string) {
+	go addReactions(r.session, r.channelID, messageID, emoji)
+}
+
+func (r *channelResponder) Reject(err error) {
+	reject(r.message, err)
+}
+
+func (r *channelResponder) DirectMessage(userID string) (Responder, error) {
+	channel, err := r.session.UserChannelCreate(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &channelResponder{session: r.session, channelID: channel.ID}, nil
+}
+
+// The id of the guild the command came from, or "" in DMs
+func (c *CommandContext) guildID() string {
+	if c.Guild == nil {
+		return ""
+	}
+	return c.Guild.ID
+}
+
+// The settings of the guild the command came from, or the defaults in DMs
+func (c *CommandContext) settings() *GuildSettings {
+	return c.Settings.Get(c.guildID())
+}
+
+// Whether the user can manage the bot's settings here, see isGuildAdmin
+func (c *CommandContext) isGuildAdmin() bool {
+	return c.Guild != nil && isGuildAdmin(c.State, c.settings(), c.Author.ID, c.ChannelID)
+}
+
+// Whether the user can manage the server, see isServerAdmin
+func (c *CommandContext) isServerAdmin() bool {
+	return c.Guild != nil && isServerAdmin(c.State, c.Author.ID, c.ChannelID)
+}
+
+// Records the command in the audit log, with err as its outcome
+func (c *CommandContext) audit(err error) {
+	auditCommand(c.Audit, c.MessageCreate, c.guildID(), err)
+}
+
+var (
+	// Every registered command, keyed by name and alias (with the !)
+	COMMANDS      = make(map[string]*Command)
+	commandsMutex sync.RWMutex
+
+	// When each user last ran each command, keyed by command name and user id
+	commandCooldowns      = make(map[string]time.Time)
+	commandCooldownsMutex sync.Mutex
+)
+
+// Adds a command to the router, panicking if its name or an alias is already taken
+func registerCommand(cmd *Command) {
+	commandsMutex.Lock()
+	defer commandsMutex.Unlock()
+
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, ok := COMMANDS["!"+name]; ok {
+			panic(fmt.Sprintf("command !%s registered twice", name))
+		}
+		COMMANDS["!"+name] = cmd
+	}
+}
+
+// Finds a command by name or alias, with or without the !
+func findCommand(name string) *Command {
+	commandsMutex.RLock()
+	defer commandsMutex.RUnlock()
+	return COMMANDS["!"+strings.TrimPrefix(name, "!")]
+}
+
+// Every registered command once, sorted by name
+func listCommands() []*Command {
+	commandsMutex.RLock()
+	defer commandsMutex.RUnlock()
+
+	cmds := make([]*Command, 0, len(COMMANDS))
+	for key, cmd := range COMMANDS {
+		if key == "!"+cmd.Name {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Usage line for a command, eg `!party <minutes> [category...]`
+func (cmd *Command) Synopsis() string {
+	if cmd.Args == "" {
+		return "!" + cmd.Name
+	}
+	return "!" + cmd.Name + " " + cmd.Args
+}
+
+// Runs a command after checking the user is allowed to, reporting any error as a rejection
+func dispatchCommand(cmd *Command, c *CommandContext) {
+	// Commands write hints like `!help`, which need to use the guild's own prefix
+	if c.Guild != nil {
+		c.Responder = &prefixedResponder{Responder: c.Responder, settings: c.Settings, guildID: c.Guild.ID}
+	}
+
+	if err := cmd.Execute(c); err != nil {
+		c.Reject(err)
+	}
+}
+
+// Checks permissions, role rules and cooldowns, then runs the command
+func (cmd *Command) Execute(c *CommandContext) error {
+	if c.Guild == nil && !cmd.DirectMessages {
+		return fmt.Errorf("`!%s` only works on a server.", cmd.Name)
+	}
+
+	// Permissions and role rules are per guild, so there's nothing to check in DMs
+	if c.Guild != nil {
+		if cmd.Permission == PERMISSION_GUILD_ADMIN && !c.isGuildAdmin() {
+			c.audit(ErrNotGuildAdmin)
+			return ErrNotGuildAdmin
+		}
+
+		settings := c.settings()
+		if !commandAllowed(c.State, settings, c.Guild.ID, c.Author.ID, c.ChannelID, cmd.Name) {
+			return fmt.Errorf("`!%s` is only for %s here.", cmd.Name, describeRoles(c.State, c.Guild.ID, settings.CommandRoles[cmd.Name]))
+		}
+	}
+
+	if left := cmd.startCooldown(c.Author.ID); left > 0 {
+		return fmt.Errorf("Slow down, you can use `!%s` again in %s.", cmd.Name, left.Round(time.Second))
+	}
+	return cmd.Run(c)
+}
+
+// Starts the user's cooldown for this command, or if they're still on one, returns how long
+// they have left
+func (cmd *Command) startCooldown(userID string) time.Duration {
+	if cmd.Cooldown <= 0 {
+		return 0
+	}
+
+	commandCooldownsMutex.Lock()
+	defer commandCooldownsMutex.Unlock()
+
+	key := cmd.Name + ":" + userID
+	if left := cmd.Cooldown - time.Since(commandCooldowns[key]); left > 0 {
+		return left
+	}
+	commandCooldowns[key] = time.Now()
+	return 0
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	testGuildID   = "router-guild"
+	testChannelID = "router-channel"
+	testOwnerID   = "router-owner"
+	testMemberID  = "router-member"
+	testRoleID    = "router-role"
+)
+
+// Records what a command sends instead of sending it
+type fakeResponder struct {
+	channelID string
+	replies   []string
+	embeds    []*discordgo.MessageEmbed
+	edits     map[string][]string
+	reactions map[string][]string
+	rejected  []error
+	dms       map[string]*fakeResponder
+}
+
+func newFakeResponder(channelID string) *fakeResponder {
+	return &fakeResponder{
+		channelID: channelID,
+		edits:     make(map[string][]string),
+		reactions: make(map[string][]string),
+		dms:       make(map[string]*fakeResponder),
+	}
+}
+
+func (r *fakeResponder) message() *discordgo.Message {
+	return &discordgo.Message{
+		ID:        fmt.Sprintf("%s-%d", r.channelID, len(r.replies)+len(r.embeds)),
+		ChannelID: r.channelID,
+	}
+}
+
+func (r *fakeResponder) Reply(text string) (*discordgo.Message, error) {
+	msg := r.message()
+	r.replies = append(r.replies, text)
+	return msg, nil
+}
+
+func (r *fakeResponder) ReplyEmbed(embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	msg := r.message()
+	r.embeds = append(r.embeds, embed)
+	return msg, nil
+}
+
+// Edits are kept by message id, with embeds kept by their title
+func (r *fakeResponder) Edit(messageID, text string) (*discordgo.Message, error) {
+	r.edits[messageID] = append(r.edits[messageID], text)
+	return &discordgo.Message{ID: messageID, ChannelID: r.channelID}, nil
+}
+
+func (r *fakeResponder) EditEmbed(messageID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return r.Edit(messageID, embed.Title)
+}
+
+func (r *fakeResponder) React(messageID string, emoji ...string) {
+	r.reactions[messageID] = append(r.reactions[messageID], emoji...)
+}
+
+func (r *fakeResponder) Reject(err error) {
+	r.rejected = append(r.rejected, err)
+}
+
+func (r *fakeResponder) DirectMessage(userID string) (Responder, error) {
+	if r.dms[userID] == nil {
+		r.dms[userID] = newFakeResponder("dm-" + userID)
+	}
+	return r.dms[userID], nil
+}
+
+// Guild settings kept in memory
+type memorySettings map[string]*GuildSettings
+
+func (s memorySettings) Get(guildID string) *GuildSettings {
+	if settings, ok := s[guildID]; ok {
+		return settings
+	}
+	return &GuildSettings{}
+}
+
+func (s memorySettings) Update(guildID string, change func(*GuildSettings)) error {
+	settings := s.Get(guildID)
+	change(settings)
+	s[guildID] = settings
+	return nil
+}
+
+// Keeps audited actions
+type fakeAudit struct {
+	actions []string
+}
+
+func (a *fakeAudit) Record(actorID, guildID, action string, args []string, err error) {
+	a.actions = append(a.actions, action)
+}
+
+// A command context for a message in the test guild (or a DM without one), with a state
+// that has the owner and a plain member in it
+func testCommandContext(userID, content string, guild bool) (*CommandContext, *fakeResponder, *fakeAudit) {
+	state := discordgo.NewState()
+	g := &discordgo.Guild{ID: testGuildID, OwnerID: testOwnerID}
+	state.GuildAdd(g)
+	state.ChannelAdd(&discordgo.Channel{ID: testChannelID, GuildID: testGuildID})
+	state.RoleAdd(testGuildID, &discordgo.Role{ID: testRoleID, Name: "dj"})
+	for _, id := range []string{testOwnerID, testMemberID} {
+		state.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: id}})
+	}
+
+	m := &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        "command",
+		ChannelID: testChannelID,
+		Content:   content,
+		Author:    &discordgo.User{ID: userID},
+	}}
+
+	r, a := newFakeResponder(testChannelID), &fakeAudit{}
+	c := &CommandContext{
+		MessageCreate: m,
+		Responder:     r,
+		State:         state,
+		Settings:      make(memorySettings),
+		Audit:         a,
+		Args:          commandArgs(m),
+	}
+
+	if guild {
+		c.GuildID, c.Guild = testGuildID, g
+	}
+	return c, r, a
+}
+
+var ranEcho []string
+
+func init() {
+	registerCommand(&Command{
+		Name:     "testecho",
+		Aliases:  []string{"testsay"},
+		Help:     "Says it back",
+		Cooldown: time.Minute,
+		Run: func(c *CommandContext) error {
+			ranEcho = append(ranEcho, c.Author.ID)
+			c.Reply(strings.Join(c.Args, " "))
+			return nil
+		},
+	})
+}
+
+func TestFindCommandByAlias(t *testing.T) {
+	cmd := findCommand("!testsay")
+	if cmd == nil || cmd.Name != "testecho" {
+		t.Fatalf("!testsay should find !testecho, got %v", cmd)
+	}
+
+	if findCommand("testsay") != cmd {
+		t.Fatal("commands should be found without the !")
+	}
+
+	for _, listed := range listCommands() {
+		if listed.Name == "testsay" {
+			t.Fatal("aliases shouldn't be listed as commands of their own")
+		}
+	}
+}
+
+func TestDispatchRejectsNonAdmins(t *testing.T) {
+	c, r, a := testCommandContext(testMemberID, "!trigger list", true)
+	dispatchCommand(findCommand("trigger"), c)
+
+	if len(r.rejected) != 1 || r.rejected[0] != ErrNotGuildAdmin {
+		t.Fatalf("a member running !trigger should be rejected as not an admin, got %v", r.rejected)
+	}
+
+	if len(a.actions) != 1 || a.actions[0] != "trigger list" {
+		t.Fatalf("the denied command should be audited, got %v", a.actions)
+	}
+
+	c, r, _ = testCommandContext(testOwnerID, "!trigger list", true)
+	dispatchCommand(findCommand("trigger"), c)
+	if len(r.rejected) != 0 || len(r.replies) != 1 {
+		t.Fatalf("the owner should be able to run !trigger, got %v", r.rejected)
+	}
+}
+
+func TestDispatchAdminRoleIsAdmin(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!trigger list", true)
+	c.Settings.Update(testGuildID, func(gs *GuildSettings) { gs.AdminRole = testRoleID })
+	c.State.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: testMemberID}, Roles: []string{testRoleID}})
+
+	dispatchCommand(findCommand("trigger"), c)
+	if len(r.rejected) != 0 {
+		t.Fatalf("members with the admin role should be able to run !trigger, got %v", r.rejected)
+	}
+}
+
+func TestDispatchRejectsRestrictedCommands(t *testing.T) {
+	c, r, _ := testCommandContext("router-restricted", "!testecho hi", true)
+	c.Settings.Update(testGuildID, func(gs *GuildSettings) {
+		gs.CommandRoles = map[string][]string{"testecho": {testRoleID}}
+	})
+
+	dispatchCommand(findCommand("testecho"), c)
+	if len(r.rejected) != 1 || !strings.Contains(r.rejected[0].Error(), "@dj") {
+		t.Fatalf("!testecho should be rejected for people without @dj, got %v", r.rejected)
+	}
+}
+
+func TestDispatchCooldown(t *testing.T) {
+	const userID = "router-cooldown"
+	c, r, _ := testCommandContext(userID, "!testsay hi there", true)
+	cmd := findCommand("testsay")
+
+	dispatchCommand(cmd, c)
+	if len(r.replies) != 1 || r.replies[0] != "hi there" {
+		t.Fatalf("!testsay should reply with its args, got %v", r.replies)
+	}
+
+	dispatchCommand(cmd, c)
+	if len(r.rejected) != 1 || !strings.HasPrefix(r.rejected[0].Error(), "Slow down") {
+		t.Fatalf("a second !testsay should hit the cooldown, got %v", r.rejected)
+	}
+
+	runs := 0
+	for _, id := range ranEcho {
+		if id == userID {
+			runs++
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("!testsay should only have run once, ran %d times", runs)
+	}
+}
+
+func TestDispatchRendersGuildPrefix(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!trivia 0", true)
+	c.Settings.Update(testGuildID, func(gs *GuildSettings) { gs.Prefix = "?" })
+
+	dispatchCommand(findCommand("trivia"), c)
+	if len(r.rejected) != 1 {
+		t.Fatalf("!trivia 0 should be rejected with the usage, got %v", r.rejected)
+	}
+
+	text := r.rejected[0].Error()
+	if !strings.Contains(text, "`?trivia stop`") || strings.Contains(text, "`!") {
+		t.Fatalf("the usage should use the guild's prefix, got %q", text)
+	}
+
+	c, r, _ = testCommandContext(testMemberID, "!help", true)
+	c.Settings.Update(testGuildID, func(gs *GuildSettings) { gs.Prefix = "?" })
+	dispatchCommand(findCommand("help"), c)
+	if footer := r.embeds[0].Footer.Text; !strings.Contains(footer, "?help <category>") {
+		t.Fatalf("the help footer should use the guild's prefix, got %q", footer)
+	}
+}
+
+func TestRenderPrefixOnlyTouchesCommands(t *testing.T) {
+	settings := &GuildSettings{Prefix: "horn!"}
+	got := renderPrefix(settings, "Try `!help airhorn` or !testsay, or !airhorn. Smoothie! !nothinglikethis")
+	want := "Try `horn!help airhorn` or horn!testsay, or horn!airhorn. Smoothie! !nothinglikethis"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDispatchServerOnlyCommandInDM(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!queue", false)
+	dispatchCommand(findCommand("queue"), c)
+
+	if len(r.rejected) != 1 || len(r.replies) != 0 {
+		t.Fatalf("!queue should be rejected in DMs, got %v", r.rejected)
+	}
+}
+
+// All the text of some help pages
+func helpText(pages []*discordgo.MessageEmbed) string {
+	text := make([]string, 0, len(pages))
+	for _, page := range pages {
+		text = append(text, page.Title, page.Description)
+	}
+	return strings.Join(text, "\n")
+}
+
+func TestHelpListsRegisteredCommands(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!help", true)
+	dispatchCommand(findCommand("help"), c)
+
+	if len(r.rejected) != 0 || len(r.embeds) != 1 {
+		t.Fatalf("!help should reply with one page, got %d and %v", len(r.embeds), r.rejected)
+	}
+
+	pages := generalHelp(testGuildID, c.settings())
+	if !strings.Contains(helpText(pages), "`!testecho` Says it back") {
+		t.Fatal("help should list !testecho with its help")
+	}
+
+	if len(pages) > 1 {
+		if reactions := r.reactions[testChannelID+"-0"]; len(reactions) != 2 || reactions[0] != BOARD_PREV || reactions[1] != BOARD_NEXT {
+			t.Fatalf("help with more than one page should get the arrows, got %v", reactions)
+		}
+	}
+}
+
+func TestHelpTurnsPagesThroughResponder(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!help", true)
+	pages := generalHelp(testGuildID, c.settings())
+	if len(pages) < 2 {
+		t.Skip("help fits on one page")
+	}
+
+	dispatchCommand(findCommand("help"), c)
+	help := findHelpMessage(testChannelID + "-0")
+	if help == nil {
+		t.Fatal("help with more than one page should be kept so it can be turned")
+	}
+
+	help.React(BOARD_NEXT)
+	help.React(BOARD_PREV)
+	if edits := r.edits[help.MessageID]; len(edits) != 2 || edits[0] != pages[1].Title || edits[1] != pages[0].Title {
+		t.Fatalf("the arrows should edit the help message to turn its pages, got %v", edits)
+	}
+}
+
+func TestHelpInDMsOnlyListsDMCommands(t *testing.T) {
+	text := helpText(generalHelp("", &GuildSettings{}))
+	if strings.Contains(text, "!testecho") || strings.Contains(text, "!trigger") {
+		t.Fatal("help in DMs should leave out server only commands")
+	}
+
+	if !strings.Contains(text, "`!help") {
+		t.Fatal("help in DMs should list !help")
+	}
+}
+
+func TestHelpDM(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!help dm testecho", true)
+	dispatchCommand(findCommand("help"), c)
+
+	dm := r.dms[testMemberID]
+	if dm == nil || len(dm.replies) != 1 || !strings.Contains(dm.replies[0], "Also works as !testsay") {
+		t.Fatal("!help dm testecho should DM the help for !testecho")
+	}
+
+	if len(r.replies) != 0 || len(r.reactions["command"]) != 1 {
+		t.Fatal("!help dm should only react to the command in the channel")
+	}
+}
+
+func TestHelpUnknownTopic(t *testing.T) {
+	c, r, _ := testCommandContext(testMemberID, "!help nothinglikethis", true)
+	dispatchCommand(findCommand("help"), c)
+
+	if len(r.rejected) != 1 || errors.Is(r.rejected[0], ErrHelpDM) {
+		t.Fatalf("!help with an unknown topic should be rejected, got %v", r.rejected)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Schedule plays a sound in a voice channel at a set time, either once or repeating
+type Schedule struct {
+	ID        int       `json:"id"`
+	Sound     *SoundRef `json:"sound"`
+	ChannelID string    `json:"channel"`
+	UserID    string    `json:"user"`
+
+	// When the schedule next plays
+	At time.Time `json:"at"`
+
+	// "daily" or "weekly" for recurring schedules, empty for one-off ones
+	Repeat string `json:"repeat,omitempty"`
+}
+
+var (
+	// How often the scheduler looks for schedules that are due
+	SCHEDULE_INTERVAL = time.Second * 15
+
+	// Schedules that were missed (eg. while the bot was down) by more than this are skipped
+	SCHEDULE_GRACE = time.Minute * 10
+
+	// Most schedules a single guild can have at once
+	MAX_SCHEDULES = 25
+
+	ErrScheduleUsage = errors.New("Try `!schedule 10m airhorn truck`, `!schedule every friday 17:00 rankup 5 #lounge`, `!schedule list` or `!schedule cancel <number>`.")
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+func (sc *Schedule) String() string {
+	when := sc.At.In(time.Local).Format("Mon Jan 2 15:04")
+	switch sc.Repeat {
+	case "daily":
+		when = "every day at " + sc.At.In(time.Local).Format("15:04")
+	case "weekly":
+		when = "every " + sc.At.In(time.Local).Format("Monday at 15:04")
+	}
+	return fmt.Sprintf("#%d `%s` in <#%s> %s (by <@%s>)", sc.ID, sc.Sound, sc.ChannelID, when, sc.UserID)
+}
+
+// Moves a recurring schedule to its next play after now, returning false for one-off schedules
+func (sc *Schedule) Advance(now time.Time) bool {
+	days := 0
+	switch sc.Repeat {
+	case "daily":
+		days = 1
+	case "weekly":
+		days = 7
+	default:
+		return false
+	}
+
+	// Step in local time so the schedule keeps its wall clock time over daylight savings
+	at := sc.At.In(time.Local)
+	for !at.After(now) {
+		at = at.AddDate(0, 0, days)
+	}
+	sc.At = at
+	return true
+}
+
+// Looks for due schedules every SCHEDULE_INTERVAL until shutdown
+func runScheduler() {
+	ticker := time.NewTicker(SCHEDULE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdownStarted:
+			return
+		case now := <-ticker.C:
+			for _, guildID := range shardGuildIDs() {
+				runDueSchedules(guildID, now)
+			}
+		}
+	}
+}
+
+// Plays any of a guild's schedules that are due, then advances or removes them
+func runDueSchedules(guildID string, now time.Time) {
+	due := make([]*Schedule, 0)
+	for _, sc := range getGuildSettings(guildID).Schedules {
+		if !sc.At.After(now) {
+			due = append(due, sc)
+		}
+	}
+
+	if len(due) == 0 {
+		return
+	}
+
+	for _, sc := range due {
+		if now.Sub(sc.At) > SCHEDULE_GRACE {
+			log.WithFields(log.Fields{
+				"guild":    guildID,
+				"schedule": sc.ID,
+				"at":       sc.At,
+			}).Warning("Skipping missed schedule")
+			continue
+		}
+		playSchedule(guildID, sc)
+	}
+
+	err := updateGuildSettings(guildID, func(gs *GuildSettings) {
+		remaining := make([]*Schedule, 0, len(gs.Schedules))
+		for _, sc := range gs.Schedules {
+			if sc.At.After(now) || sc.Advance(now) {
+				remaining = append(remaining, sc)
+			}
+		}
+		gs.Schedules = remaining
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guildID,
+			"error": err,
+		}).Error("Failed to update schedules")
+	}
+}
+
+func playSchedule(guildID string, sc *Schedule) {
+	guild, _ := discord.State.Guild(guildID)
+	channel, _ := discord.State.Channel(sc.ChannelID)
+	coll, sound := sc.Sound.Resolve()
+
+	// Nobody to hear it, so don't bother
+	if guild == nil || channel == nil || coll == nil || !channelHasHumans(discord.State, guildID, channel.ID) {
+		return
+	}
+
+	user := &discordgo.User{ID: sc.UserID}
+	if member, _ := discord.State.Member(guildID, sc.UserID); member != nil && member.User != nil {
+		user = member.User
+	}
+
+	play, err := preparePlay(discord.State, user, guild, channel, coll, sound)
+	if err == nil {
+		play.tag("schedule")
+		_, err = enqueuePlay(play)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":    guildID,
+			"channel":  channel.ID,
+			"schedule": sc.ID,
+			"error":    err,
+		}).Warning("Failed to play schedule")
+	}
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:  "schedule",
+		Args:  "<delay> <category> [sound]|list|cancel <number>",
+		Help:  "Plays a sound later, or every day or week",
+		Usage: ErrScheduleUsage.Error(),
+		Run:   handleScheduleCommand,
+	})
+}
+
+// Handles `!schedule <delay> <sound>`, `!schedule every <day> <hh:mm> <sound> <#channel>`
+// (admins only), `!schedule list` and `!schedule cancel <number>`
+func handleScheduleCommand(c *CommandContext) error {
+	args := strings.Fields(c.Content)[1:]
+	if len(args) == 0 {
+		return ErrScheduleUsage
+	}
+
+	var (
+		reply string
+		err   error
+	)
+
+	switch strings.ToLower(args[0]) {
+	case "list":
+		schedules := c.settings().Schedules
+		if len(schedules) == 0 {
+			reply = "Nothing is scheduled."
+			break
+		}
+
+		lines := make([]string, 0, len(schedules))
+		for _, sc := range schedules {
+			lines = append(lines, sc.String())
+		}
+		reply = strings.Join(lines, "\n")
+	case "cancel", "remove", "rm":
+		var id int
+		if len(args) < 2 {
+			err = ErrScheduleUsage
+			break
+		} else if id, err = strconv.Atoi(strings.TrimPrefix(args[1], "#")); err != nil {
+			err = fmt.Errorf("**%s** isn't a schedule number.", args[1])
+			break
+		}
+
+		admin := c.isGuildAdmin()
+		found, allowed := false, false
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			for i, sc := range gs.Schedules {
+				if sc.ID != id {
+					continue
+				}
+
+				found = true
+				if allowed = admin || sc.UserID == c.Author.ID; allowed {
+					gs.Schedules = append(gs.Schedules[:i], gs.Schedules[i+1:]...)
+				}
+				break
+			}
+		})
+
+		if err == nil && !found {
+			err = fmt.Errorf("There's no schedule #%d.", id)
+		} else if err == nil && !allowed {
+			err = errors.New("You can only cancel your own schedules.")
+		}
+		reply = fmt.Sprintf(":ok_hand: Cancelled schedule #%d.", id)
+	default:
+		var sc *Schedule
+		sc, err = parseSchedule(c, args)
+		if err != nil {
+			break
+		}
+
+		if len(c.settings().Schedules) >= MAX_SCHEDULES {
+			err = fmt.Errorf("This server already has %d schedules, cancel some first.", MAX_SCHEDULES)
+			break
+		}
+
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			gs.NextScheduleID++
+			sc.ID = gs.NextScheduleID
+			gs.Schedules = append(gs.Schedules, sc)
+		})
+		reply = fmt.Sprintf(":ok_hand: Scheduled %s", sc)
+	}
+
+	// Admins can set up recurring schedules and cancel anyone's, so keep track of what they do
+	if strings.ToLower(args[0]) != "list" && c.isGuildAdmin() {
+		c.audit(err)
+	}
+
+	if err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Parses a new schedule from command arguments, eg `10m airhorn truck` or
+// `every friday 17:00 play rankup 5 in #lounge`
+func parseSchedule(c *CommandContext, args []string) (*Schedule, error) {
+	channel, args, err := findTargetChannel(c.State, c.MessageCreate, c.Guild, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let people write it out like a sentence
+	words := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg = strings.ToLower(arg); arg != "play" && arg != "in" && arg != "at" {
+			words = append(words, arg)
+		}
+	}
+
+	sc := &Schedule{UserID: c.Author.ID}
+	now := time.Now()
+
+	if len(words) > 0 && words[0] == "every" {
+		if !c.isGuildAdmin() {
+			return nil, errors.New("Only server admins can set up recurring schedules.")
+		} else if len(words) < 3 {
+			return nil, ErrScheduleUsage
+		}
+
+		clock, err := time.ParseInLocation("15:04", words[2], time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("**%s** isn't a time, try something like `17:00`.", words[2])
+		}
+
+		sc.At = time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+		if words[1] == "day" {
+			sc.Repeat = "daily"
+		} else if weekday, ok := weekdays[words[1]]; ok {
+			sc.Repeat = "weekly"
+			sc.At = sc.At.AddDate(0, 0, (int(weekday)-int(sc.At.Weekday())+7)%7)
+		} else {
+			return nil, fmt.Errorf("**%s** isn't a day, try `day` or something like `friday`.", words[1])
+		}
+
+		if !sc.At.After(now) {
+			sc.Advance(now)
+		}
+		words = words[3:]
+	} else if len(words) > 0 {
+		delay, err := time.ParseDuration(words[0])
+		if err != nil || delay <= 0 {
+			return nil, ErrScheduleUsage
+		}
+		sc.At = now.Add(delay)
+		words = words[1:]
+	}
+
+	ref, err := parseSoundRef(words)
+	if err != nil {
+		return nil, err
+	}
+	sc.Sound = ref
+
+	// Without a channel, play wherever the person scheduling it is now
+	if channel == nil {
+		channel = getCurrentVoiceChannel(c.State, c.Author, c.Guild)
+		if channel == nil {
+			return nil, ErrNotInVoice
+		}
+	}
+
+	if err := checkVoicePermissions(c.State, c.State.Ready.User.ID, channel); err != nil {
+		return nil, err
+	}
+	sc.ChannelID = channel.ID
+	return sc, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Most results a search will list
+	MAX_SEARCH_RESULTS = 25
+
+	// Longest reply a search will send, leaving room under discord's message limit
+	MAX_SEARCH_REPLY = 1900
+)
+
+// Finds sounds in the collections a guild's settings allow whose name, description or category
+// contains the term
+func searchSounds(settings *GuildSettings, term string) []string {
+	results := make([]string, 0)
+	for _, coll := range allowedCollections(settings) {
+		collMatches := strings.Contains(coll.Prefix, term)
+		for _, sound := range coll.Sounds {
+			if collMatches || strings.Contains(sound.Name, term) || strings.Contains(strings.ToLower(sound.Description), term) {
+				results = append(results, soundResult(coll, sound))
+			}
+		}
+	}
+	return results
+}
+
+// Finds sounds in the collections a guild's settings allow whose transcript contains the term.
+// Most sounds don't have a transcript yet, so if none match it falls back to their names.
+func searchQuotes(settings *GuildSettings, term string) []string {
+	results, named := make([]string, 0), make([]string, 0)
+	for _, coll := range allowedCollections(settings) {
+		for _, sound := range coll.Sounds {
+			if strings.Contains(strings.ToLower(sound.Transcript), term) {
+				results = append(results, soundResult(coll, sound))
+			} else if strings.Contains(sound.Name, term) {
+				named = append(named, soundResult(coll, sound))
+			}
+		}
+	}
+
+	if len(results) == 0 {
+		return named
+	}
+	return results
+}
+
+// A sound as a search result, eg `!airhorn spam · Lots of quick airhorns`
+func soundResult(coll *SoundCollection, sound *Sound) string {
+	result := fmt.Sprintf("%s %s", coll.Commands[0], sound.Name)
+	if summary := sound.Summary(coll); summary != "" {
+		result += " · " + summary
+	}
+	return result
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:     "search",
+		Args:     "<word>",
+		Help:     "Finds sounds by name or description",
+		Cooldown: time.Second * 3,
+		Run:      handleSearchCommand,
+
+		DirectMessages: true,
+	})
+
+	registerCommand(&Command{
+		Name:     "quote",
+		Args:     "\"<words>\"",
+		Help:     "Finds sounds by what's said in them",
+		Cooldown: time.Second * 3,
+		Run:      handleQuoteCommand,
+
+		DirectMessages: true,
+	})
+}
+
+// Handles `!search <term>`
+func handleSearchCommand(c *CommandContext) error {
+	args := c.Args
+	if len(args) == 0 {
+		return errors.New("Search for what? Try something like `!search horn`.")
+	}
+
+	term := strings.Join(args, " ")
+	replySearchResults(c, term, searchSounds(c.settings(), term))
+	return nil
+}
+
+// Handles `!quote "<words>"`
+func handleQuoteCommand(c *CommandContext) error {
+	term := strings.Trim(strings.Join(c.Args, " "), "\"“”")
+	if term == "" {
+		return errors.New("Quote what? Try something like `!quote \"smoothie\"`.")
+	}
+
+	replySearchResults(c, term, searchQuotes(c.settings(), term))
+	return nil
+}
+
+// Lists search results, cutting them off before the reply gets too long
+func replySearchResults(c *CommandContext, term string, results []string) {
+	if len(results) == 0 {
+		c.Reply(fmt.Sprintf("Nothing matches **%s**. ¯\\_(ツ)_/¯", term))
+		return
+	}
+
+	lines, length := make([]string, 0), 0
+	for _, result := range results {
+		if length += len(result) + 1; length > MAX_SEARCH_REPLY || len(lines) >= MAX_SEARCH_RESULTS {
+			break
+		}
+		lines = append(lines, result)
+	}
+
+	if len(lines) < len(results) {
+		lines = append(lines, fmt.Sprintf("...and %d more, try something more specific.", len(results)-len(lines)))
+	}
+	c.Reply(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Loads the metadata fixture, putting the sounds it changes back afterwards
+func loadTestMetadata(t *testing.T) {
+	for _, sound := range []*Sound{AIRHORN.Find("default"), SEALAB.Find("smoothie")} {
+		sound, original := sound, *sound
+		t.Cleanup(func() { *sound = original })
+	}
+
+	if err := loadSoundMetadata("testdata/metadata.json"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSoundMetadata(t *testing.T) {
+	loadTestMetadata(t)
+
+	sound := AIRHORN.Find("default")
+	if sound.Transcript != "Get out of the way of the truck" || sound.AddedBy != "fixture" {
+		t.Fatalf("the fixture should be loaded onto airhorn default, got %+v", sound)
+	}
+
+	if !sound.Added.Equal(time.Date(2016, 5, 21, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("the added date should be parsed, got %s", sound.Added)
+	}
+}
+
+func TestSearchQuotesMatchesTranscripts(t *testing.T) {
+	loadTestMetadata(t)
+
+	want := "!airhorn default · The classic airhorn · “Get out of the way of the truck” · added by fixture on 21 May 2016"
+	results := searchQuotes(&GuildSettings{}, "way of the truck")
+	if len(results) != 1 || results[0] != want {
+		t.Fatalf("got %q, want %q", results, want)
+	}
+
+	// airhorn truck is only named it, so a transcript saying it wins
+	if results = searchQuotes(&GuildSettings{}, "truck"); len(results) != 1 || results[0] != want {
+		t.Fatalf("names shouldn't match when a transcript does, got %q", results)
+	}
+}
+
+func TestSearchQuotesFallsBackToNames(t *testing.T) {
+	results := searchQuotes(&GuildSettings{}, "fritters")
+	if len(results) != 1 || results[0] != "!sealab fritters" {
+		t.Fatalf("without a transcript match, sounds should be found by name, got %q", results)
+	}
+}
+
+func TestSearchQuotesFindsSmoothie(t *testing.T) {
+	loadTestMetadata(t)
+
+	results := searchQuotes(&GuildSettings{}, "smoothie")
+	if len(results) != 1 || results[0] != "!sealab smoothie · “Smoothie!”" {
+		t.Fatalf("!quote smoothie should find sealab smoothie by its transcript, got %q", results)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	redis "gopkg.in/redis.v3"
+)
+
+// GuildSettings holds everything a guild's admins can configure. Settings are kept in memory
+// and persisted to redis (when we have it) as JSON. Treat a *GuildSettings as read only, all
+// changes should go through updateGuildSettings.
+type GuildSettings struct {
+	// Intro sounds played when someone joins a voice channel, keyed by user id
+	Intros map[string]*SoundRef `json:"intros,omitempty"`
+
+	// If true, nobody gets an intro in this guild
+	IntrosDisabled bool `json:"intros_disabled,omitempty"`
+
+	// Chat triggers, checked in order, and the id the next one will get
+	Triggers      []*Trigger `json:"triggers,omitempty"`
+	NextTriggerID int        `json:"next_trigger_id,omitempty"`
+
+	// Scheduled plays, and the id the next one will get
+	Schedules      []*Schedule `json:"schedules,omitempty"`
+	NextScheduleID int         `json:"next_schedule_id,omitempty"`
+
+	// Party limits, zero values fall back to the PARTY_* defaults and an empty list of
+	// collections allows all of them
+	PartyMaxMinutes  int      `json:"party_max_minutes,omitempty"`
+	PartyMinInterval int      `json:"party_min_interval,omitempty"`
+	PartyMaxInterval int      `json:"party_max_interval,omitempty"`
+	PartyCollections []string `json:"party_collections,omitempty"`
+
+	// Play policies: cooldowns keyed by collection prefix or "prefix sound", the longest clip
+	// the guild accepts, and a cooldown shared by every clip longer than LongSound
+	SoundCooldowns      map[string]time.Duration `json:"sound_cooldowns,omitempty"`
+	CollectionCooldowns map[string]time.Duration `json:"collection_cooldowns,omitempty"`
+	MaxDuration         time.Duration            `json:"max_duration,omitempty"`
+	LongSound           time.Duration            `json:"long_sound,omitempty"`
+	LongSoundCooldown   time.Duration            `json:"long_sound_cooldown,omitempty"`
+
+	// Category filters: NSFW collections can be hidden, any collection can be disabled, and a
+	// non empty allowlist hides everything not on it
+	NSFWDisabled        bool     `json:"nsfw_disabled,omitempty"`
+	DisabledCollections []string `json:"disabled_collections,omitempty"`
+	AllowedCollections  []string `json:"allowed_collections,omitempty"`
+
+	// Role that can manage these settings without being able to manage the server, and the
+	// roles allowed to use restricted bot commands (keyed without the `!`) and collections
+	AdminRole       string              `json:"admin_role,omitempty"`
+	CommandRoles    map[string][]string `json:"command_roles,omitempty"`
+	CollectionRoles map[string][]string `json:"collection_roles,omitempty"`
+
+	// Prefix commands start with instead of `!`, and other names for commands keyed without
+	// the prefix, eg "horn" to "airhorn" or "hype" to "rankup 5"
+	Prefix  string            `json:"prefix,omitempty"`
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// SoundRef points at a sound in the catalog. An empty Sound means a random one from the
+// collection.
+type SoundRef struct {
+	Collection string `json:"collection"`
+	Sound      string `json:"sound,omitempty"`
+}
+
+var (
+	// Cached settings for each guild we've seen, keyed by guild id
+	guildSettings      = make(map[string]*GuildSettings)
+	guildSettingsMutex sync.Mutex
+)
+
+// Finds the collection and sound this points to, returning a nil collection if it no longer exists
+func (r *SoundRef) Resolve() (*SoundCollection, *Sound) {
+	coll := findCollection(r.Collection)
+	if coll == nil || r.Sound == "" {
+		return coll, nil
+	}
+
+	sound := coll.Find(r.Sound)
+	if sound == nil {
+		return nil, nil
+	}
+	return coll, sound
+}
+
+func (r *SoundRef) String() string {
+	if r.Sound == "" {
+		return r.Collection
+	}
+	return r.Collection + " " + r.Sound
+}
+
+// Parses a sound reference from command arguments, eg `cena full` or just `cena`
+func parseSoundRef(args []string) (*SoundRef, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Which sound? Try something like `airhorn truck`.")
+	}
+
+	coll := findCollection(args[0])
+	if coll == nil {
+		return nil, fmt.Errorf("I don't have a category called **%s**, try `!help`.", args[0])
+	}
+
+	ref := &SoundRef{Collection: coll.Prefix}
+	if len(args) > 1 {
+		sound := coll.Find(args[1])
+		if sound == nil {
+			return nil, fmt.Errorf("I don't have a sound called **%s**, try `!help %s`.", args[1], args[0])
+		}
+		ref.Sound = sound.Name
+	}
+	return ref, nil
+}
+
+func guildSettingsKey(guildID string) string {
+	return fmt.Sprintf("airhorn:settings:guild:%s", guildID)
+}
+
+// Returns the settings for a guild, loading them from redis the first time
+func getGuildSettings(guildID string) *GuildSettings {
+	// DMs have no guild, and so nothing but the defaults
+	if guildID == "" {
+		return &GuildSettings{}
+	}
+
+	guildSettingsMutex.Lock()
+	defer guildSettingsMutex.Unlock()
+
+	if settings, ok := guildSettings[guildID]; ok {
+		return settings
+	}
+
+	settings := &GuildSettings{}
+	if rcli != nil {
+		data, err := rcli.Get(guildSettingsKey(guildID)).Result()
+		if err == nil {
+			err = json.Unmarshal([]byte(data), settings)
+		}
+
+		if err != nil && err != redis.Nil {
+			log.WithFields(log.Fields{
+				"guild": guildID,
+				"error": err,
+			}).Error("Failed to load guild settings")
+			settings = &GuildSettings{}
+		}
+	}
+
+	guildSettings[guildID] = settings
+	return settings
+}
+
+// Applies a change to a copy of a guild's settings, then saves and swaps in the result
+func updateGuildSettings(guildID string, change func(*GuildSettings)) error {
+	// Make sure the settings are loaded before taking the lock
+	getGuildSettings(guildID)
+
+	guildSettingsMutex.Lock()
+	defer guildSettingsMutex.Unlock()
+
+	data, err := json.Marshal(guildSettings[guildID])
+	if err != nil {
+		return err
+	}
+
+	settings := &GuildSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return err
+	}
+	change(settings)
+
+	if rcli != nil {
+		data, err = json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+
+		if err := rcli.Set(guildSettingsKey(guildID), string(data), 0).Err(); err != nil {
+			log.WithFields(log.Fields{
+				"guild": guildID,
+				"error": err,
+			}).Error("Failed to save guild settings")
+			return err
+		}
+	}
+
+	guildSettings[guildID] = settings
+	return nil
+}
+
+// Loads the settings of several guilds from redis in one round trip, leaving out guilds that
+// have none. It skips the cache, so it's for reading many guilds at once and sees changes
+// other shards made. Without redis the cache is all there is, so that's used instead.
+func loadGuildSettings(guildIDs []string) (map[string]*GuildSettings, error) {
+	all := make(map[string]*GuildSettings)
+	if rcli == nil {
+		for _, id := range guildIDs {
+			all[id] = getGuildSettings(id)
+		}
+		return all, nil
+	}
+
+	if len(guildIDs) == 0 {
+		return all, nil
+	}
+
+	keys := make([]string, len(guildIDs))
+	for i, id := range guildIDs {
+		keys[i] = guildSettingsKey(id)
+	}
+
+	values, err := rcli.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		settings := &GuildSettings{}
+		if err := json.Unmarshal([]byte(data), settings); err != nil {
+			log.WithFields(log.Fields{
+				"guild": guildIDs[i],
+				"error": err,
+			}).Error("Failed to load guild settings")
+			continue
+		}
+		all[guildIDs[i]] = settings
+	}
+	return all, nil
+}
+
+// redisSettings is the SettingsStore commands use for real, the cache in front of redis
+type redisSettings struct{}
+
+func (redisSettings) Get(guildID string) *GuildSettings {
+	return getGuildSettings(guildID)
+}
+
+func (redisSettings) Update(guildID string, change func(*GuildSettings)) error {
+	return updateGuildSettings(guildID, change)
+}
+
+// Redis hash of collection prefixes to "1" or "0", for collections switched on or off at runtime
+const COLLECTION_STATES_KEY = "airhorn:settings:collections"
+
+// Restores which collections were switched on or off before the last restart
+func loadCollectionStates() {
+	if rcli == nil {
+		return
+	}
+
+	states, err := rcli.HGetAllMap(COLLECTION_STATES_KEY).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load collection states")
+		return
+	}
+
+	for _, coll := range COLLECTIONS {
+		if state, ok := states[coll.Prefix]; ok {
+			coll.SetEnabled(state == "1")
+		}
+	}
+}
+
+// Switches a collection on or off, saving the change so it survives restarts
+func setCollectionEnabled(coll *SoundCollection, enabled bool) error {
+	coll.SetEnabled(enabled)
+	if rcli == nil {
+		return nil
+	}
+
+	state := "0"
+	if enabled {
+		state = "1"
+	}
+	return rcli.HSet(COLLECTION_STATES_KEY, coll.Prefix, state).Err()
+}
+
+// Whether a user can manage the bot's settings for a guild, checked against the channel
+// they're talking in and the settings of its guild. That's anyone who can manage the server,
+// plus the guild's bot admin role.
+func isGuildAdmin(state *discordgo.State, settings *GuildSettings, userID, channelID string) bool {
+	if isServerAdmin(state, userID, channelID) {
+		return true
+	}
+
+	channel, err := state.Channel(channelID)
+	if err != nil {
+		return false
+	}
+	return settings.AdminRole != "" && memberHasRole(state, channel.GuildID, userID, []string{settings.AdminRole})
+}
+
+// Splits a command into its arguments, dropping the command itself
+func commandArgs(m *discordgo.MessageCreate) []string {
+	args := strings.Fields(strings.ToLower(m.Content))
+	if len(args) == 0 {
+		return args
+	}
+	return args[1:]
+}
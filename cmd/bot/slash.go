@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Most choices Discord will show for an autocompleted option
+const MAX_AUTOCOMPLETE_CHOICES = 25
+
+// Lowest page `/help` accepts, a var since discord wants a pointer to it
+var MIN_HELP_PAGE = 1.0
+
+// Application (slash) commands, registered with `bot register`
+var SLASH_COMMANDS = []*discordgo.ApplicationCommand{
+	{
+		Name:        "play",
+		Description: "Play a sound in your voice channel",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "collection",
+				Description:  "Category to play from, eg airhorn",
+				Required:     true,
+				Autocomplete: true,
+			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "sound",
+				Description:  "Sound to play, or leave it out for a random one",
+				Autocomplete: true,
+			},
+		},
+	},
+	{
+		Name:        "help",
+		Description: "List the categories I can play, or the sounds in one",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "collection",
+				Description:  "Category to list the sounds of",
+				Autocomplete: true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "page",
+				Description: "Page of help to show",
+				MinValue:    &MIN_HELP_PAGE,
+			},
+		},
+	},
+	{
+		Name:        "stats",
+		Description: "How many sounds someone has played",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "Who to look up, or leave it out for yourself",
+			},
+		},
+	},
+	{
+		Name:        "queue",
+		Description: "Show what's playing and what's waiting to play",
+	},
+}
+
+// InteractionResponder answers interactions. A *discordgo.Session is one, and a stand-in that
+// records responses lets interactions be handled without a gateway connection.
+type InteractionResponder interface {
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+}
+
+// InteractionContext is everything a slash command gets to work with. Like CommandContext, it's
+// looked things up in instead of the live session, so interactions can be handled against
+// stand-ins.
+type InteractionContext struct {
+	*discordgo.Interaction
+
+	// Cached guilds and members, for finding who's in which voice channel
+	State *discordgo.State
+
+	Settings SettingsStore
+}
+
+func onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	c := &InteractionContext{Interaction: i.Interaction, State: s.State, Settings: redisSettings{}}
+	if err := handleInteraction(s, c); err != nil {
+		log.WithFields(log.Fields{
+			"guild":       i.GuildID,
+			"interaction": i.ID,
+			"error":       err,
+		}).Warning("Failed to respond to interaction")
+	}
+}
+
+// Works out the response to an interaction and sends it
+func handleInteraction(r InteractionResponder, c *InteractionContext) error {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return nil
+	}
+
+	// Every shard sees the interaction, but only one of them should answer it. DMs have no
+	// guild, so they're split up by channel instead.
+	home := c.GuildID
+	if home == "" {
+		home = c.ChannelID
+	}
+
+	if !shardContains(home) {
+		return nil
+	}
+
+	var resp *discordgo.InteractionResponse
+	switch c.Type {
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		resp = autocompleteResponse(c)
+	case discordgo.InteractionApplicationCommand:
+		resp = slashCommandResponse(c)
+	default:
+		return nil
+	}
+	return r.InteractionRespond(c.Interaction, resp)
+}
+
+// The user behind an interaction, whether it came from a guild or a DM
+func interactionUser(i *discordgo.Interaction) *discordgo.User {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// Finds a string option by name, returning "" if it wasn't given
+func stringOption(options []*discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	for _, option := range options {
+		if option.Name == name && option.Type == discordgo.ApplicationCommandOptionString {
+			return strings.ToLower(option.StringValue())
+		}
+	}
+	return ""
+}
+
+func slashCommandResponse(c *InteractionContext) *discordgo.InteractionResponse {
+	data := c.ApplicationCommandData()
+
+	var (
+		reply string
+		embed *discordgo.MessageEmbed
+		err   error
+	)
+
+	switch data.Name {
+	case "play":
+		reply, err = slashPlay(c, data.Options)
+	case "help":
+		embed, err = slashHelp(c, data.Options)
+	case "stats":
+		reply, err = slashStats(c, data.Options)
+	case "queue":
+		if c.GuildID == "" {
+			err = errors.New("There's only a queue on servers.")
+			break
+		}
+		reply = describeQueue(c.State, c.GuildID)
+	default:
+		err = fmt.Errorf("I don't know `/%s`.", data.Name)
+	}
+
+	// Mistakes and lookups are only shown to whoever asked, sounds being played are for everyone
+	flags := discordgo.MessageFlagsEphemeral
+	if err != nil {
+		reply, embed = FEEDBACK_REJECTED+" "+err.Error(), nil
+	} else if data.Name == "play" {
+		flags = 0
+	}
+
+	// Hints like `!help` are for the guild's text commands, so they use its prefix
+	if c.GuildID != "" {
+		reply = renderPrefix(c.Settings.Get(c.GuildID), reply)
+		if embed != nil {
+			embed = renderPrefixEmbed(c.Settings.Get(c.GuildID), embed)
+		}
+	}
+
+	var embeds []*discordgo.MessageEmbed
+	if embed != nil {
+		embeds = []*discordgo.MessageEmbed{embed}
+	}
+
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:         reply,
+			Embeds:          embeds,
+			Flags:           flags,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		},
+	}
+}
+
+// Handles `/play collection [sound]`
+func slashPlay(c *InteractionContext, options []*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+	guild, _ := c.State.Guild(c.GuildID)
+	if guild == nil {
+		return "", errors.New("Sounds can only be played on a server.")
+	}
+
+	name := stringOption(options, "collection")
+	coll := findGuildCollection(c.Settings.Get(guild.ID), name)
+	if coll == nil {
+		return "", fmt.Errorf("I don't have a category called **%s**, try `/help`.", name)
+	}
+
+	var sound *Sound
+	if soundName := stringOption(options, "sound"); soundName != "" {
+		if sound = coll.Find(soundName); sound == nil {
+			return "", fmt.Errorf("I don't have a sound called **%s**, try `/help %s`.", soundName, coll.Prefix)
+		}
+	}
+
+	play, err := preparePlay(c.State, interactionUser(c.Interaction), guild, nil, coll, sound)
+	if err != nil {
+		return "", err
+	}
+	play.tag("slash")
+
+	queued, err := enqueuePlay(play)
+	if err != nil {
+		return "", err
+	} else if queued {
+		return fmt.Sprintf("%s Queued **%s**", FEEDBACK_QUEUED, describePlay(play)), nil
+	}
+	return fmt.Sprintf("%s Playing **%s**", FEEDBACK_ACCEPTED, describePlay(play)), nil
+}
+
+// Handles `/help [collection] [page]`. Reactions can't be added to a reply only one person can
+// see, so the page is picked up front instead.
+func slashHelp(c *InteractionContext, options []*discordgo.ApplicationCommandInteractionDataOption) (*discordgo.MessageEmbed, error) {
+	settings := c.Settings.Get(c.GuildID)
+	pages := generalHelp(c.GuildID, settings)
+	if name := stringOption(options, "collection"); name != "" {
+		coll := findGuildCollection(settings, name)
+		if coll == nil {
+			return nil, fmt.Errorf("I don't have a category called **%s**.", name)
+		}
+		pages = collectionHelp(coll)
+	}
+
+	page := 1
+	for _, option := range options {
+		if option.Name == "page" {
+			page = int(option.IntValue())
+		}
+	}
+
+	// Discord should keep it to MIN_HELP_PAGE, but don't count on it
+	if page < 1 {
+		page = 1
+	} else if page > len(pages) {
+		return nil, fmt.Errorf("There are only %d pages.", len(pages))
+	}
+	return pages[page-1], nil
+}
+
+// Handles `/stats [user]`
+func slashStats(c *InteractionContext, options []*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+	user := interactionUser(c.Interaction)
+	for _, option := range options {
+		if option.Name == "user" {
+			user = option.UserValue(nil)
+		}
+	}
+	return describeUserStats(user.ID)
+}
+
+// Suggests collections or sounds for whichever option is being typed
+func autocompleteResponse(c *InteractionContext) *discordgo.InteractionResponse {
+	data := c.ApplicationCommandData()
+	settings := c.Settings.Get(c.GuildID)
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0)
+
+	for _, option := range data.Options {
+		if !option.Focused {
+			continue
+		}
+
+		typed := strings.ToLower(option.StringValue())
+		switch option.Name {
+		case "collection":
+			for _, coll := range allowedCollections(settings) {
+				if strings.Contains(coll.Prefix, typed) {
+					choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: coll.Prefix, Value: coll.Prefix})
+				}
+			}
+		case "sound":
+			coll := findGuildCollection(settings, stringOption(data.Options, "collection"))
+			if coll == nil {
+				break
+			}
+
+			for _, sound := range coll.Sounds {
+				if strings.Contains(sound.Name, typed) {
+					choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: sound.Name, Value: sound.Name})
+				}
+			}
+		}
+	}
+
+	if len(choices) > MAX_AUTOCOMPLETE_CHOICES {
+		choices = choices[:MAX_AUTOCOMPLETE_CHOICES]
+	}
+
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	}
+}
+
+// SlashRegistrar tells Discord about application commands. A *discordgo.Session is one.
+type SlashRegistrar interface {
+	User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error)
+	ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+}
+
+// Handles `bot register -t <token> [-g <guild id>]`, which tells Discord about the slash
+// commands. Without a guild they're registered globally, which can take a while to show up.
+func registerSlashCommands(args []string) {
+	var (
+		flags = flag.NewFlagSet("register", flag.ExitOnError)
+		Token = flags.String("t", "", "Discord Authentication Token")
+		Guild = flags.String("g", "", "Only register the commands in this guild")
+	)
+	flags.Parse(args)
+
+	session, err := discordgo.New(*Token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Failed to create discord session")
+		return
+	}
+
+	commands, err := overwriteSlashCommands(session, *Guild)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": *Guild,
+			"error": err,
+		}).Fatal("Failed to register slash commands")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":    *Guild,
+		"commands": len(commands),
+	}).Info("Registered slash commands")
+}
+
+// Replaces the bot's slash commands with SLASH_COMMANDS, in one guild or globally for ""
+func overwriteSlashCommands(r SlashRegistrar, guildID string) ([]*discordgo.ApplicationCommand, error) {
+	app, err := r.User("@me")
+	if err != nil {
+		return nil, fmt.Errorf("looking up the bot's application: %v", err)
+	}
+	return r.ApplicationCommandBulkOverwrite(app.ID, guildID, SLASH_COMMANDS)
+}
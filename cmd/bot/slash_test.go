@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Keeps the responses instead of sending them
+type fakeInteractionResponder struct {
+	responses []*discordgo.InteractionResponse
+}
+
+func (r *fakeInteractionResponder) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	r.responses = append(r.responses, resp)
+	return nil
+}
+
+func stringArg(name, value string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionString, Value: value}
+}
+
+// Handles a slash command (or autocomplete, with a focused option) from the test member in the
+// test guild, or a DM without it, returning the response
+func interact(t *testing.T, guild bool, kind discordgo.InteractionType, name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionResponse {
+	state := discordgo.NewState()
+	state.GuildAdd(&discordgo.Guild{ID: testGuildID, OwnerID: testOwnerID})
+	state.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: testMemberID}})
+	return interactIn(t, state, guild, kind, name, options...)
+}
+
+// Like interact, but against a state set up by the test
+func interactIn(t *testing.T, state *discordgo.State, guild bool, kind discordgo.InteractionType, name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionResponse {
+	i := &discordgo.Interaction{
+		ID:        "interaction",
+		Type:      kind,
+		ChannelID: testChannelID,
+		Data:      discordgo.ApplicationCommandInteractionData{Name: name, Options: options},
+	}
+
+	user := &discordgo.User{ID: testMemberID}
+	if guild {
+		i.GuildID, i.Member = testGuildID, &discordgo.Member{User: user}
+	} else {
+		i.User = user
+	}
+
+	r := &fakeInteractionResponder{}
+	if err := handleInteraction(r, &InteractionContext{Interaction: i, State: state, Settings: make(memorySettings)}); err != nil {
+		t.Fatalf("/%s failed: %v", name, err)
+	}
+
+	if len(r.responses) != 1 {
+		t.Fatalf("/%s should get one response, got %d", name, len(r.responses))
+	}
+	return r.responses[0]
+}
+
+func command(t *testing.T, guild bool, name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionResponseData {
+	return interact(t, guild, discordgo.InteractionApplicationCommand, name, options...).Data
+}
+
+func rejection(err error) string {
+	return FEEDBACK_REJECTED + " " + err.Error()
+}
+
+func TestSlashPlay(t *testing.T) {
+	if data := command(t, false, "play", stringArg("collection", "airhorn")); data.Content != rejection(errors.New("Sounds can only be played on a server.")) {
+		t.Fatalf("/play in a DM should be rejected, got %q", data.Content)
+	}
+
+	if data := command(t, true, "play", stringArg("collection", "nothinglikethis")); !strings.Contains(data.Content, "I don't have a category called **nothinglikethis**") {
+		t.Fatalf("/play with an unknown category should be rejected, got %q", data.Content)
+	}
+
+	if data := command(t, true, "play", stringArg("collection", "airhorn"), stringArg("sound", "nothinglikethis")); !strings.Contains(data.Content, "I don't have a sound called **nothinglikethis**") {
+		t.Fatalf("/play with an unknown sound should be rejected, got %q", data.Content)
+	}
+
+	data := command(t, true, "play", stringArg("collection", "airhorn"), stringArg("sound", "default"))
+	if data.Content != rejection(ErrNotInVoice) {
+		t.Fatalf("/play outside a voice channel should be rejected, got %q", data.Content)
+	} else if data.Flags != discordgo.MessageFlagsEphemeral {
+		t.Fatal("rejections should only be shown to whoever asked")
+	}
+}
+
+func TestSlashPlayQueuesSound(t *testing.T) {
+	const botID, voiceID = "slash-bot", "slash-voice"
+	AIRHORN.SetEnabled(true)
+
+	// The member is in a voice channel everyone can connect to and speak in, bot included
+	state := discordgo.NewState()
+	state.Ready = discordgo.Ready{User: &discordgo.User{ID: botID}}
+	state.GuildAdd(&discordgo.Guild{
+		ID:          testGuildID,
+		OwnerID:     testOwnerID,
+		Roles:       []*discordgo.Role{{ID: testGuildID, Permissions: discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak}},
+		Channels:    []*discordgo.Channel{{ID: voiceID, GuildID: testGuildID, Type: discordgo.ChannelTypeGuildVoice}},
+		VoiceStates: []*discordgo.VoiceState{{GuildID: testGuildID, ChannelID: voiceID, UserID: testMemberID}},
+	})
+	for _, id := range []string{testMemberID, botID} {
+		state.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: id}})
+	}
+
+	// Something is already playing, so the sound waits in the queue instead of joining voice
+	queuesMutex.Lock()
+	queues[testGuildID] = make(chan *Play, MAX_QUEUE_SIZE)
+	nowPlaying[testGuildID] = &Play{GuildID: testGuildID}
+	queuesMutex.Unlock()
+	defer func() {
+		queuesMutex.Lock()
+		deleteQueueLocked(testGuildID)
+		queuesMutex.Unlock()
+	}()
+
+	data := interactIn(t, state, true, discordgo.InteractionApplicationCommand, "play", stringArg("collection", "airhorn"), stringArg("sound", "default")).Data
+	if data.Content != FEEDBACK_QUEUED+" Queued **!airhorn default**" || data.Flags != 0 {
+		t.Fatalf("/play should queue the sound for everyone to see, got %q", data.Content)
+	}
+
+	_, waiting := guildQueue(testGuildID)
+	if len(waiting) != 1 || waiting[0].ChannelID != voiceID || waiting[0].Source != "slash" {
+		t.Fatalf("the play should be queued in the member's voice channel, got %v", waiting)
+	}
+}
+
+func TestSlashHelp(t *testing.T) {
+	data := command(t, true, "help")
+	if len(data.Embeds) != 1 || data.Embeds[0].Title != generalHelp(testGuildID, &GuildSettings{})[0].Title {
+		t.Fatal("/help should show the first page of help")
+	}
+
+	data = command(t, true, "help", stringArg("collection", "airhorn"))
+	if len(data.Embeds) != 1 || !strings.Contains(data.Embeds[0].Description, "`default`") {
+		t.Fatal("/help airhorn should list the airhorn sounds")
+	}
+
+	page := &discordgo.ApplicationCommandInteractionDataOption{Name: "page", Type: discordgo.ApplicationCommandOptionInteger, Value: 1000.0}
+	if data = command(t, true, "help", page); !strings.HasPrefix(data.Content, FEEDBACK_REJECTED+" There are only") {
+		t.Fatalf("/help past the last page should be rejected, got %q", data.Content)
+	}
+
+	page.Value = -1.0
+	if data = command(t, true, "help", page); len(data.Embeds) != 1 || data.Embeds[0].Title != generalHelp(testGuildID, &GuildSettings{})[0].Title {
+		t.Fatalf("/help before the first page should show the first page, got %q", data.Content)
+	}
+}
+
+func TestSlashStats(t *testing.T) {
+	user := &discordgo.ApplicationCommandInteractionDataOption{Name: "user", Type: discordgo.ApplicationCommandOptionUser, Value: testOwnerID}
+	data := command(t, true, "stats", user)
+
+	// Without redis there are no stats to show
+	if data.Content != rejection(errors.New("I'm not keeping stats right now.")) || data.Flags != discordgo.MessageFlagsEphemeral {
+		t.Fatalf("/stats without redis should say so, got %q", data.Content)
+	}
+}
+
+func TestSlashQueue(t *testing.T) {
+	if data := command(t, false, "queue"); data.Content != rejection(errors.New("There's only a queue on servers.")) {
+		t.Fatalf("/queue in a DM should be rejected, got %q", data.Content)
+	}
+
+	if data := command(t, true, "queue"); data.Content != "Nothing is playing right now." {
+		t.Fatalf("/queue should say nothing is playing, got %q", data.Content)
+	}
+}
+
+func choiceNames(resp *discordgo.InteractionResponse) []string {
+	names := make([]string, 0, len(resp.Data.Choices))
+	for _, choice := range resp.Data.Choices {
+		names = append(names, choice.Name)
+	}
+	return names
+}
+
+func TestSlashAutocomplete(t *testing.T) {
+	typed := stringArg("collection", "airh")
+	typed.Focused = true
+	resp := interact(t, true, discordgo.InteractionApplicationCommandAutocomplete, "play", typed)
+	if resp.Type != discordgo.InteractionApplicationCommandAutocompleteResult || !scontains("airhorn", choiceNames(resp)...) {
+		t.Fatalf("typing airh should suggest airhorn, got %v", choiceNames(resp))
+	}
+
+	typed = stringArg("sound", "tru")
+	typed.Focused = true
+	resp = interact(t, true, discordgo.InteractionApplicationCommandAutocomplete, "play", stringArg("collection", "airhorn"), typed)
+	if names := choiceNames(resp); !scontains("truck", names...) || scontains("default", names...) {
+		t.Fatalf("typing tru should suggest truck and nothing that doesn't match, got %v", names)
+	}
+
+	typed = stringArg("sound", "")
+	typed.Focused = true
+	resp = interact(t, true, discordgo.InteractionApplicationCommandAutocomplete, "play", stringArg("collection", "nothinglikethis"), typed)
+	if len(resp.Data.Choices) != 0 {
+		t.Fatalf("an unknown category shouldn't suggest sounds, got %v", choiceNames(resp))
+	}
+}
+
+func TestSlashOtherShards(t *testing.T) {
+	defer func(shards []string) { SHARDS = shards }(SHARDS)
+	SHARDS = []string{"x"}
+
+	r := &fakeInteractionResponder{}
+	i := &discordgo.Interaction{Type: discordgo.InteractionApplicationCommand, GuildID: "123456789"}
+	if err := handleInteraction(r, &InteractionContext{Interaction: i, Settings: make(memorySettings)}); err != nil || len(r.responses) != 0 {
+		t.Fatal("interactions for other shards should be left alone")
+	}
+}
+
+// Records slash command registrations
+type fakeRegistrar struct {
+	appID, guildID string
+	commands       []*discordgo.ApplicationCommand
+}
+
+func (r *fakeRegistrar) User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	return &discordgo.User{ID: "app"}, nil
+}
+
+func (r *fakeRegistrar) ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	r.appID, r.guildID, r.commands = appID, guildID, commands
+	return commands, nil
+}
+
+func TestOverwriteSlashCommands(t *testing.T) {
+	r := &fakeRegistrar{}
+	commands, err := overwriteSlashCommands(r, testGuildID)
+	if err != nil || len(commands) != len(SLASH_COMMANDS) {
+		t.Fatalf("every slash command should be registered, got %d and %v", len(commands), err)
+	}
+
+	if r.appID != "app" || r.guildID != testGuildID {
+		t.Fatalf("the commands should be registered for the bot in the guild, got %s in %s", r.appID, r.guildID)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Trigger plays a sound in the authors voice channel when a phrase shows up in text chat
+type Trigger struct {
+	ID int `json:"id"`
+
+	// A keyword or phrase matched as whole words, or a regular expression if Regex is set
+	Pattern string `json:"pattern"`
+	Regex   bool   `json:"regex,omitempty"`
+
+	Sound *SoundRef `json:"sound"`
+
+	// Text channels the trigger listens in, empty means all of them
+	Channels []string `json:"channels,omitempty"`
+
+	// Minimum time between two plays of this trigger
+	Cooldown time.Duration `json:"cooldown"`
+}
+
+var (
+	// Cooldown for triggers added without one
+	TRIGGER_DEFAULT_COOLDOWN = time.Second * 30
+
+	// Compiled trigger patterns, keyed by the pattern source
+	triggerPatterns      = make(map[string]*regexp.Regexp)
+	triggerPatternsMutex sync.Mutex
+
+	// When each trigger last fired, keyed by its stats source
+	triggerCooldowns      = make(map[string]time.Time)
+	triggerCooldownsMutex sync.Mutex
+
+	ErrTriggerUsage = errors.New("Try `!trigger add <\"phrase\"|/regex/> <category> [sound] [cooldown=30s] [#channels]`, `!trigger list` or `!trigger remove <number>`.")
+)
+
+// The stats source this trigger's plays are counted under
+func (t *Trigger) Source(guildID string) string {
+	return fmt.Sprintf("trigger:%s:%d", guildID, t.ID)
+}
+
+func (t *Trigger) String() string {
+	pattern := fmt.Sprintf("\"%s\"", t.Pattern)
+	if t.Regex {
+		pattern = fmt.Sprintf("/%s/", t.Pattern)
+	}
+
+	desc := fmt.Sprintf("#%d %s → `%s` (cooldown %s)", t.ID, pattern, t.Sound, t.Cooldown)
+	for _, channelID := range t.Channels {
+		desc += fmt.Sprintf(" <#%s>", channelID)
+	}
+	return desc
+}
+
+// Compiles (and caches) the regular expression for this trigger
+func (t *Trigger) compile() (*regexp.Regexp, error) {
+	source := `(?i)\b` + regexp.QuoteMeta(t.Pattern) + `\b`
+	if t.Regex {
+		source = t.Pattern
+	}
+
+	triggerPatternsMutex.Lock()
+	defer triggerPatternsMutex.Unlock()
+
+	if re, ok := triggerPatterns[source]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	triggerPatterns[source] = re
+	return re, nil
+}
+
+// Whether the trigger should fire for a message in a channel
+func (t *Trigger) Matches(channelID, content string) bool {
+	if len(t.Channels) > 0 && !scontains(channelID, t.Channels...) {
+		return false
+	}
+
+	re, err := t.compile()
+	return err == nil && re.MatchString(content)
+}
+
+// Checks a chat message against the guild's triggers, playing the first one that matches
+func checkTriggers(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.Bot {
+		return
+	}
+
+	channel, _ := s.State.Channel(m.ChannelID)
+	if channel == nil || channel.GuildID == "" || !shardContains(channel.GuildID) {
+		return
+	}
+
+	settings := getGuildSettings(channel.GuildID)
+	for _, trigger := range settings.Triggers {
+		if !trigger.Matches(m.ChannelID, m.Content) {
+			continue
+		}
+
+		coll, sound := trigger.Sound.Resolve()
+		guild, _ := s.State.Guild(channel.GuildID)
+		if coll == nil || guild == nil || triggerOnCooldown(trigger.Source(guild.ID), trigger.Cooldown) {
+			continue
+		}
+
+		// People chatting outside of voice shouldn't get told off for it, so errors are only logged
+		play, err := preparePlay(s.State, m.Author, guild, nil, coll, sound)
+		if err == nil {
+			play.tag(trigger.Source(guild.ID))
+			_, err = enqueuePlay(play)
+		}
+
+		if err == nil {
+			startTriggerCooldown(trigger.Source(guild.ID))
+		} else {
+			log.WithFields(log.Fields{
+				"guild":   guild.ID,
+				"trigger": trigger.ID,
+				"error":   err,
+			}).Debug("Trigger matched but could not play")
+		}
+		return
+	}
+}
+
+// Whether a trigger played too recently to play again
+func triggerOnCooldown(source string, cooldown time.Duration) bool {
+	triggerCooldownsMutex.Lock()
+	defer triggerCooldownsMutex.Unlock()
+
+	last, ok := triggerCooldowns[source]
+	return ok && time.Since(last) < cooldown
+}
+
+// Restarts a triggers cooldown once it has played
+func startTriggerCooldown(source string) {
+	triggerCooldownsMutex.Lock()
+	defer triggerCooldownsMutex.Unlock()
+
+	triggerCooldowns[source] = time.Now()
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:       "trigger",
+		Args:       "add|list|remove ...",
+		Help:       "Plays sounds when phrases come up in chat",
+		Usage:      ErrTriggerUsage.Error(),
+		Permission: PERMISSION_GUILD_ADMIN,
+		Run:        handleTriggerCommand,
+	})
+}
+
+// Handles the admin only `!trigger add|list|remove` commands
+func handleTriggerCommand(c *CommandContext) error {
+	args := splitQuoted(c.Content)[1:]
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	var (
+		reply string
+		err   error
+	)
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		var trigger *Trigger
+		trigger, err = parseTrigger(args[1:])
+		if err != nil {
+			break
+		}
+
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			gs.NextTriggerID++
+			trigger.ID = gs.NextTriggerID
+			gs.Triggers = append(gs.Triggers, trigger)
+		})
+		reply = fmt.Sprintf(":ok_hand: Added trigger %s", trigger)
+	case "list":
+		triggers := c.settings().Triggers
+		if len(triggers) == 0 {
+			reply = "No triggers yet, add one with `!trigger add \"gg\" gg today`."
+			break
+		}
+
+		lines := make([]string, 0, len(triggers))
+		for _, trigger := range triggers {
+			lines = append(lines, trigger.String())
+		}
+		reply = strings.Join(lines, "\n")
+	case "remove", "rm", "delete":
+		var id int
+		if len(args) < 2 {
+			err = errors.New("Which trigger? Try `!trigger remove <number>`.")
+			break
+		} else if id, err = strconv.Atoi(strings.TrimPrefix(args[1], "#")); err != nil {
+			err = fmt.Errorf("**%s** isn't a trigger number.", args[1])
+			break
+		}
+
+		found := false
+		err = c.Settings.Update(c.Guild.ID, func(gs *GuildSettings) {
+			for i, trigger := range gs.Triggers {
+				if trigger.ID == id {
+					gs.Triggers = append(gs.Triggers[:i], gs.Triggers[i+1:]...)
+					found = true
+					break
+				}
+			}
+		})
+
+		if err == nil && !found {
+			err = fmt.Errorf("There's no trigger #%d.", id)
+		}
+		reply = fmt.Sprintf(":ok_hand: Removed trigger #%d.", id)
+	default:
+		err = ErrTriggerUsage
+	}
+
+	if strings.ToLower(args[0]) != "list" {
+		c.audit(err)
+	}
+
+	if err != nil {
+		return err
+	}
+	c.Reply(reply)
+	return nil
+}
+
+// Parses the arguments to `!trigger add`: a "phrase" or /regex/, a sound reference, and
+// optionally a cooldown=<duration> and channel mentions to limit it to
+func parseTrigger(args []string) (*Trigger, error) {
+	if len(args) < 2 {
+		return nil, errors.New("Try `!trigger add <\"phrase\"|/regex/> <category> [sound] [cooldown=30s] [#channels]`.")
+	}
+
+	trigger := &Trigger{
+		Pattern:  args[0],
+		Cooldown: TRIGGER_DEFAULT_COOLDOWN,
+	}
+
+	if len(trigger.Pattern) > 2 && strings.HasPrefix(trigger.Pattern, "/") && strings.HasSuffix(trigger.Pattern, "/") {
+		trigger.Pattern = trigger.Pattern[1 : len(trigger.Pattern)-1]
+		trigger.Regex = true
+	}
+
+	if _, err := trigger.compile(); err != nil {
+		return nil, fmt.Errorf("That pattern doesn't work: %s", err)
+	}
+
+	refArgs := make([]string, 0, 2)
+	for _, arg := range args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "<#") && strings.HasSuffix(arg, ">"):
+			trigger.Channels = append(trigger.Channels, arg[2:len(arg)-1])
+		case strings.HasPrefix(strings.ToLower(arg), "cooldown="):
+			cooldown, err := time.ParseDuration(arg[len("cooldown="):])
+			if err != nil || cooldown < 0 {
+				return nil, fmt.Errorf("**%s** isn't a cooldown, try something like `cooldown=1m`.", arg)
+			}
+			trigger.Cooldown = cooldown
+		default:
+			refArgs = append(refArgs, strings.ToLower(arg))
+		}
+	}
+
+	ref, err := parseSoundRef(refArgs)
+	if err != nil {
+		return nil, err
+	}
+	trigger.Sound = ref
+	return trigger, nil
+}
+
+// Splits a message on spaces, keeping "quoted phrases" together
+func splitQuoted(content string) []string {
+	var (
+		parts  = make([]string, 0)
+		quoted = false
+		buf    strings.Builder
+	)
+
+	flush := func() {
+		if buf.Len() > 0 {
+			parts = append(parts, buf.String())
+			buf.Reset()
+		}
+	}
+
+	for _, r := range content {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			if !quoted {
+				flush()
+			}
+		case r == ' ' && !quoted:
+			flush()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	flush()
+	return parts
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// TriviaGame plays random sounds in voice and scores whoever names them first in text chat.
+// Naming the sound is worth 2 points, naming just the category is worth 1.
+type TriviaGame struct {
+	GuildID        string
+	TextChannelID  string
+	VoiceChannelID string
+	UserID         string
+	Rounds         int
+	RoundTime      time.Duration
+
+	// Points scored this game, keyed by user id
+	scores map[string]int
+
+	// The sound being guessed (nil between rounds)
+	coll  *SoundCollection
+	sound *Sound
+
+	// Where the game was started from, for posting rounds and looking up the guild
+	responder Responder
+	state     *discordgo.State
+	settings  SettingsStore
+
+	solved chan triviaAnswer
+	stop   chan struct{}
+	sync.Mutex
+}
+
+type triviaAnswer struct {
+	UserID string
+	Points int
+}
+
+var (
+	// Defaults (and limits) for new games
+	TRIVIA_ROUNDS      = 5
+	TRIVIA_MAX_ROUNDS  = 20
+	TRIVIA_ROUND_TIME  = time.Second * 30
+	TRIVIA_ROUND_LIMIT = time.Minute * 2
+
+	// Pause between rounds so people can catch their breath
+	TRIVIA_ROUND_GAP = time.Second * 3
+
+	// Games currently going, keyed by the text channel they're played in
+	triviaGames      = make(map[string]*TriviaGame)
+	triviaGamesMutex sync.Mutex
+
+	ErrTriviaUsage = errors.New("Try `!trivia [rounds] [time per round, eg 30s]` to start a game, `!trivia stop` to end it and `!trivia scores` for the leaderboard.")
+)
+
+func triviaScoresKey(guildID string) string {
+	return fmt.Sprintf("airhorn:trivia:guild:%s", guildID)
+}
+
+// Returns the game going in a text channel, if any
+func getTriviaGame(channelID string) *TriviaGame {
+	triviaGamesMutex.Lock()
+	defer triviaGamesMutex.Unlock()
+	return triviaGames[channelID]
+}
+
+// Returns the game going anywhere in a guild, if any
+func getGuildTriviaGame(guildID string) *TriviaGame {
+	triviaGamesMutex.Lock()
+	defer triviaGamesMutex.Unlock()
+	return guildTriviaGameLocked(guildID)
+}
+
+// Finds the game going on in a guild. The caller must hold triviaGamesMutex.
+func guildTriviaGameLocked(guildID string) *TriviaGame {
+	for _, game := range triviaGames {
+		if game.GuildID == guildID {
+			return game
+		}
+	}
+	return nil
+}
+
+// Checks a message against the current round, returning true if it was a correct answer
+func checkTriviaAnswer(m *discordgo.MessageCreate) bool {
+	game := getTriviaGame(m.ChannelID)
+	if game == nil || m.Author.Bot {
+		return false
+	}
+
+	game.Lock()
+	defer game.Unlock()
+
+	if game.sound == nil {
+		return false
+	}
+
+	points := 0
+	words := strings.Fields(strings.ToLower(m.Content))
+	switch {
+	case len(words) == 1 && words[0] == game.sound.Name:
+		points = 2
+	case len(words) == 2 && findCollection(words[0]) == game.coll && words[1] == game.sound.Name:
+		points = 2
+	case len(words) == 1 && findCollection(words[0]) == game.coll:
+		points = 1
+	default:
+		return false
+	}
+
+	// Only the first correct answer counts
+	game.sound = nil
+	game.solved <- triviaAnswer{UserID: m.Author.ID, Points: points}
+	return true
+}
+
+// Plays through the rounds, then posts the final scoreboard
+func (g *TriviaGame) run() {
+	defer func() {
+		triviaGamesMutex.Lock()
+		if triviaGames[g.TextChannelID] == g {
+			delete(triviaGames, g.TextChannelID)
+		}
+		triviaGamesMutex.Unlock()
+
+		g.Lock()
+		g.sound = nil
+		g.Unlock()
+		g.responder.Reply(g.scoreboard())
+	}()
+
+	for round := 1; round <= g.Rounds; round++ {
+		if !g.playRound(round) {
+			return
+		}
+
+		select {
+		case <-g.stop:
+			return
+		case <-shutdownStarted:
+			return
+		case <-time.After(TRIVIA_ROUND_GAP):
+		}
+	}
+}
+
+// Plays a single round, returning false if the game should end
+func (g *TriviaGame) playRound(round int) bool {
+	guild, _ := g.state.Guild(g.GuildID)
+	channel, _ := g.state.Channel(g.VoiceChannelID)
+	if guild == nil || channel == nil || !channelHasHumans(g.state, g.GuildID, g.VoiceChannelID) {
+		return false
+	}
+
+	var (
+		coll  *SoundCollection
+		sound *Sound
+		err   error
+	)
+
+	collections := guildCollections(g.settings.Get(g.GuildID))
+	if len(collections) == 0 {
+		return false
+	}
+
+	user := &discordgo.User{ID: g.UserID}
+	for attempt := 0; attempt < 5; attempt++ {
+		coll = collections[randomRange(0, len(collections))]
+		sound = coll.Random()
+
+		var play *Play
+		play, err = preparePlay(g.state, user, guild, channel, coll, sound)
+		if err == nil {
+			play.tag("trivia")
+			_, err = enqueuePlay(play)
+		}
+
+		// Policies block some sounds, so pick another rather than give the answer away
+		if _, blocked := err.(*PolicyError); !blocked {
+			break
+		}
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   g.GuildID,
+			"channel": g.VoiceChannelID,
+			"error":   err,
+		}).Warning("Failed to play trivia sound")
+		g.responder.Reply(fmt.Sprintf("I couldn't play anything (%s), so that's the game.", err))
+		return false
+	}
+
+	// Throw away an answer that raced with the end of the last round
+	g.Lock()
+	select {
+	case <-g.solved:
+	default:
+	}
+	g.coll, g.sound = coll, sound
+	g.Unlock()
+	g.responder.Reply(fmt.Sprintf(":musical_note: **Round %d/%d**, name that sound!", round, g.Rounds))
+
+	timeout := time.NewTimer(g.RoundTime)
+	defer timeout.Stop()
+	categoryHint := time.NewTimer(g.RoundTime / 3)
+	defer categoryHint.Stop()
+	letterHint := time.NewTimer(g.RoundTime * 2 / 3)
+	defer letterHint.Stop()
+
+	answer := fmt.Sprintf("`%s %s`", coll.Commands[0], sound.Name)
+	for {
+		select {
+		case solved := <-g.solved:
+			g.award(solved)
+			g.responder.Reply(fmt.Sprintf(":tada: <@%s> got it for %d points, it was %s.", solved.UserID, solved.Points, answer))
+			return true
+		case <-categoryHint.C:
+			g.responder.Reply(fmt.Sprintf("Hint: it's in `%s`.", coll.Commands[0]))
+		case <-letterHint.C:
+			g.responder.Reply(fmt.Sprintf("Hint: it starts with `%s`.", sound.Name[:1]))
+		case <-timeout.C:
+			g.Lock()
+			g.sound = nil
+			g.Unlock()
+			g.responder.Reply(fmt.Sprintf(":hourglass: Time's up, it was %s.", answer))
+			return true
+		case <-g.stop:
+			return false
+		case <-shutdownStarted:
+			return false
+		}
+	}
+}
+
+// Adds points to the game scoreboard and the guild's all time trivia scores
+func (g *TriviaGame) award(answer triviaAnswer) {
+	g.Lock()
+	g.scores[answer.UserID] += answer.Points
+	g.Unlock()
+
+	if rcli == nil {
+		return
+	}
+
+	if err := rcli.ZIncrBy(triviaScoresKey(g.GuildID), float64(answer.Points), answer.UserID).Err(); err != nil {
+		log.WithFields(log.Fields{
+			"guild": g.GuildID,
+			"error": err,
+		}).Warning("Failed to track trivia score in redis")
+	}
+}
+
+// Renders the scores for this game, highest first
+func (g *TriviaGame) scoreboard() string {
+	g.Lock()
+	defer g.Unlock()
+
+	if len(g.scores) == 0 {
+		return ":checkered_flag: Game over, nobody scored!"
+	}
+
+	users := make([]string, 0, len(g.scores))
+	for userID := range g.scores {
+		users = append(users, userID)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return g.scores[users[i]] > g.scores[users[j]]
+	})
+
+	lines := []string{":checkered_flag: **Game over!**"}
+	for i, userID := range users {
+		lines = append(lines, fmt.Sprintf("%d. <@%s> %d", i+1, userID, g.scores[userID]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:     "trivia",
+		Args:     "[rounds] [round time]|stop|scores",
+		Help:     "Starts a game of guess-the-sound",
+		Usage:    ErrTriviaUsage.Error(),
+		Cooldown: time.Second * 10,
+		Run:      handleTriviaCommand,
+	})
+}
+
+// Handles `!trivia [rounds] [round time]`, `!trivia stop` and `!trivia scores`
+func handleTriviaCommand(c *CommandContext) error {
+	args := c.Args
+
+	var err error
+	switch {
+	case len(args) > 0 && args[0] == "stop":
+		if !stopTrivia(getTriviaGame(c.ChannelID)) {
+			err = errors.New("There's no game going in this channel.")
+		}
+	case len(args) > 0 && args[0] == "scores":
+		err = displayTriviaScores(c)
+	default:
+		err = startTrivia(c)
+	}
+	return err
+}
+
+func startTrivia(c *CommandContext) error {
+	game := &TriviaGame{
+		GuildID:       c.Guild.ID,
+		TextChannelID: c.ChannelID,
+		UserID:        c.Author.ID,
+		Rounds:        TRIVIA_ROUNDS,
+		RoundTime:     TRIVIA_ROUND_TIME,
+		responder:     c.Responder,
+		state:         c.State,
+		settings:      c.Settings,
+		scores:        make(map[string]int),
+		solved:        make(chan triviaAnswer, 1),
+		stop:          make(chan struct{}),
+	}
+
+	for _, arg := range c.Args {
+		if rounds, err := strconv.Atoi(arg); err == nil && rounds > 0 && rounds <= TRIVIA_MAX_ROUNDS {
+			game.Rounds = rounds
+		} else if roundTime, err := time.ParseDuration(arg); err == nil && roundTime >= time.Second*10 && roundTime <= TRIVIA_ROUND_LIMIT {
+			game.RoundTime = roundTime
+		} else {
+			return fmt.Errorf("Games can have 1-%d rounds of 10s-%s each. %s", TRIVIA_MAX_ROUNDS, TRIVIA_ROUND_LIMIT, ErrTriviaUsage)
+		}
+	}
+
+	channel := getCurrentVoiceChannel(c.State, c.Author, c.Guild)
+	if channel == nil {
+		return ErrNotInVoice
+	} else if err := checkVoicePermissions(c.State, c.State.Ready.User.ID, channel); err != nil {
+		return err
+	}
+	game.VoiceChannelID = channel.ID
+
+	// Checked and added under one lock so two games can't start at once
+	triviaGamesMutex.Lock()
+	if guildTriviaGameLocked(c.Guild.ID) != nil {
+		triviaGamesMutex.Unlock()
+		return errors.New("There's already a game going on this server.")
+	}
+	triviaGames[c.ChannelID] = game
+	triviaGamesMutex.Unlock()
+
+	c.Reply(fmt.Sprintf(":thinking: **Trivia!** %d rounds in **%s**, type the sound name (2 points) or its category (1 point) here.", game.Rounds, channel.Name))
+	go game.run()
+	return nil
+}
+
+// Ends a game early, returning false if there was no game to stop
+func stopTrivia(game *TriviaGame) bool {
+	if game == nil {
+		return false
+	}
+
+	triviaGamesMutex.Lock()
+	defer triviaGamesMutex.Unlock()
+
+	if triviaGames[game.TextChannelID] != game {
+		return false
+	}
+	delete(triviaGames, game.TextChannelID)
+	close(game.stop)
+	return true
+}
+
+func displayTriviaScores(c *CommandContext) error {
+	if rcli == nil {
+		return errors.New("Scores aren't being tracked right now.")
+	}
+
+	scores, err := rcli.ZRevRangeWithScores(triviaScoresKey(c.Guild.ID), 0, 9).Result()
+	if err != nil {
+		return err
+	}
+
+	if len(scores) == 0 {
+		c.Reply("Nobody has scored yet, start a game with `!trivia`.")
+		return nil
+	}
+
+	lines := []string{"**Trivia leaderboard**"}
+	for i, score := range scores {
+		lines = append(lines, fmt.Sprintf("%d. <@%v> %d", i+1, score.Member, int(score.Score)))
+	}
+	c.Reply(strings.Join(lines, "\n"))
+	return nil
+}
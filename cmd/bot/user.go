@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:     "stats",
+		Help:     "Shows how many sounds you've played",
+		Cooldown: time.Second * 5,
+		Run: func(c *CommandContext) error {
+			reply, err := describeUserStats(c.Author.ID)
+			if err != nil {
+				return err
+			}
+			c.Reply(reply)
+			return nil
+		},
+
+		DirectMessages: true,
+	})
+
+	registerCommand(&Command{
+		Name:     "settings",
+		Help:     "Shows your intros, on this server or in DMs on every server",
+		Cooldown: time.Second * 10,
+		Run: func(c *CommandContext) error {
+			reply, err := describeUserSettings(c.State, c.Author.ID, c.guildID())
+			if err != nil {
+				return err
+			}
+			c.Reply(reply)
+			return nil
+		},
+
+		DirectMessages: true,
+	})
+}
+
+// How many sounds a user has played, as a reply
+func describeUserStats(userID string) (string, error) {
+	if rcli == nil {
+		return "", errors.New("I'm not keeping stats right now.")
+	}
+
+	count, err := userSoundCount(userID)
+	if err != nil {
+		return "", errors.New("Couldn't look up the stats, try again later.")
+	}
+	return fmt.Sprintf("<@%s> has played %d sounds.", userID, count), nil
+}
+
+// Lists a user's intros in one guild, or every guild if guildID is ""
+func describeUserSettings(state *discordgo.State, userID, guildID string) (string, error) {
+	names := make(map[string]string)
+	ids := make([]string, 0)
+	state.RLock()
+	for _, guild := range state.Guilds {
+		if guildID == "" || guild.ID == guildID {
+			names[guild.ID] = guild.Name
+			ids = append(ids, guild.ID)
+		}
+	}
+	state.RUnlock()
+
+	all, err := loadGuildSettings(ids)
+	if err != nil {
+		return "", errors.New("Couldn't look up your settings, try again later.")
+	}
+
+	lines := make([]string, 0)
+	for id, settings := range all {
+		ref := settings.Intros[userID]
+		if ref == nil {
+			continue
+		}
+
+		line := fmt.Sprintf("**%s**: your intro is `%s`", names[id], ref)
+		if settings.IntrosDisabled {
+			line += " (intros are off there)"
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		return "You haven't set anything up, try `!intro set <category> [sound]` on a server.", nil
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestDescribeUserSettingsListsEveryGuild(t *testing.T) {
+	const userID = "settings-user"
+	state := discordgo.NewState()
+	for _, guild := range []*discordgo.Guild{{ID: "settings-a", Name: "A"}, {ID: "settings-b", Name: "B"}, {ID: "settings-c", Name: "C"}} {
+		state.GuildAdd(guild)
+	}
+
+	updateGuildSettings("settings-a", func(gs *GuildSettings) {
+		gs.Intros = map[string]*SoundRef{userID: {Collection: "airhorn", Sound: "truck"}}
+	})
+	updateGuildSettings("settings-b", func(gs *GuildSettings) {
+		gs.Intros = map[string]*SoundRef{userID: {Collection: "airhorn"}}
+		gs.IntrosDisabled = true
+	})
+
+	reply, err := describeUserSettings(state, userID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "**A**: your intro is `airhorn truck`\n**B**: your intro is `airhorn` (intros are off there)"
+	if reply != want {
+		t.Fatalf("got %q, want %q", reply, want)
+	}
+
+	if reply, _ = describeUserSettings(state, userID, "settings-c"); reply != "You haven't set anything up, try `!intro set <category> [sound]` on a server." {
+		t.Fatalf("a guild without an intro should have nothing to list, got %q", reply)
+	}
+}
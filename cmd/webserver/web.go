@@ -5,12 +5,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
-	"github.com/antage/eventsource"
 	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
+	"gopkg.in/antage/eventsource.v1"
 	redis "gopkg.in/redis.v3"
 	"io/ioutil"
 	"math/rand"
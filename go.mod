@@ -0,0 +1,27 @@
+module github.com/ptoast/dropbot
+
+go 1.21
+
+require (
+	github.com/bwmarrin/discordgo v0.29.0
+	github.com/dustin/go-humanize v1.0.1
+	github.com/gorilla/handlers v1.5.2
+	github.com/gorilla/sessions v1.2.2
+	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/oauth2 v0.16.0
+	gopkg.in/antage/eventsource.v1 v1.0.0-20150318155416-803f4c5af225
+	gopkg.in/redis.v3 v3.6.4
+)
+
+require (
+	github.com/felixge/httpsnoop v1.0.3 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/securecookie v1.1.2 // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/appengine v1.6.7 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a // indirect
+)